@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"weather-bff/auth"
+	"weather-bff/logging"
+	"weather-bff/trace"
+)
+
+// clientContextKey holds the authenticated *auth.Client in the gin context.
+const clientContextKey = "client"
+
+// Scopes routes can require. scopePublic routes, like the index and health
+// checks, need no API key.
+const (
+	scopePublic  = "public"
+	scopeWeather = "weather"
+	scopeFact    = "fact"
+	scopeOps     = "ops"
+)
+
+// routeScopes holds the scope each route was registered with by route.
+var routeScopes = make(map[string]string)
+
+// route registers handler for GET path, open to keys with scope when
+// authentication is on.
+func route(router *gin.Engine, path, scope string, handler gin.HandlerFunc) {
+	routeScopes[path] = scope
+	router.GET(path, handler)
+}
+
+// isPublic reports whether path was registered as a public route.
+func isPublic(path string) bool {
+	return routeScopes[path] == scopePublic
+}
+
+// authMiddleware rejects requests to every route but public ones without a
+// valid API key, or a valid signature for keys that require one, with 401,
+// and those whose key lacks the route's scope with 403. Routes registered
+// without a scope are denied to every key, and unknown paths are only
+// answered with 404 once authenticated. The client is recorded on the
+// request's logger and span.
+func authMiddleware(router *gin.Engine, authenticator *auth.Authenticator) gin.HandlerFunc {
+	routeOf := routeMatcher(router)
+
+	return func(c *gin.Context) {
+		path := c.Request.URL.Path
+		if isPublic(path) {
+			return
+		}
+
+		client, err := authenticator.Authenticate(c.Request)
+		if err != nil {
+			logging.FromContext(c.Request.Context()).Info("authentication failed", "error", err)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+
+		ctx := c.Request.Context()
+		ctx = logging.NewContext(ctx, logging.FromContext(ctx).With("client", client.Label))
+		trace.FromContext(ctx).SetAttributes(trace.String("client", client.Label))
+		c.Request = c.Request.WithContext(ctx)
+		c.Set(clientContextKey, client)
+
+		scope, ok := routeScopes[path]
+		switch {
+		case !ok && routeOf(path) == unmatchedRoute:
+			//Left to answer 404
+		case !ok:
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "route is not open to API keys"})
+		case !client.Allows(scope):
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "API key lacks the " + scope + " scope"})
+		}
+	}
+}
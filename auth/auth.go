@@ -0,0 +1,206 @@
+// Package auth authenticates API clients by key and, for keys with a secret,
+// by an HMAC signature over the request and a timestamp, which keeps captured
+// requests from being replayed.
+//
+// A signed request carries X-Timestamp, the Unix time in seconds, and
+// X-Signature, the hex HMAC-SHA256 with the key's secret of
+//
+//	METHOD \n PATH \n RAW QUERY \n TIMESTAMP
+//
+// followed, for requests with a body, by \n and the hex SHA-256 of the body.
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"weather-bff/config"
+)
+
+// Headers read by Authenticate.
+const (
+	KeyHeader       = "X-API-Key"
+	TimestampHeader = "X-Timestamp"
+	SignatureHeader = "X-Signature"
+)
+
+// Errors returned by Authenticate.
+var (
+	ErrMissingKey       = errors.New("API key required")
+	ErrUnknownKey       = errors.New("unknown API key")
+	ErrRevokedKey       = errors.New("API key has been revoked")
+	ErrMissingSignature = errors.New("request must be signed")
+	ErrBadTimestamp     = errors.New("request timestamp is missing or too far from now")
+	ErrBadSignature     = errors.New("request signature does not match")
+	ErrReplayed         = errors.New("request has already been seen")
+	ErrBodyTooLarge     = errors.New("request body is too large to verify")
+)
+
+// maxSignedBody is the largest request body a signature is checked over.
+const maxSignedBody = 1 << 20
+
+// Client is an authenticated client.
+type Client struct {
+	Label  string
+	Signed bool
+	scopes map[string]bool
+}
+
+// Allows reports whether c was granted scope.
+func (c *Client) Allows(scope string) bool {
+	return c.scopes["*"] || c.scopes[scope]
+}
+
+type entry struct {
+	key    config.ClientKey
+	scopes map[string]bool
+}
+
+// Authenticator checks requests against a fixed set of keys.
+type Authenticator struct {
+	keys    map[string]*entry
+	maxSkew time.Duration
+
+	mu    sync.Mutex
+	seen  map[string]time.Time
+	swept time.Time
+}
+
+// sweepInterval is how often expired signatures are forgotten.
+const sweepInterval = time.Minute
+
+// New returns an Authenticator for the keys in cfg.
+func New(cfg config.Auth) *Authenticator {
+	a := &Authenticator{
+		keys:    make(map[string]*entry, len(cfg.Keys)),
+		maxSkew: cfg.MaxSkew,
+		seen:    make(map[string]time.Time),
+	}
+	for _, k := range cfg.Keys {
+		e := &entry{key: k, scopes: make(map[string]bool, len(k.Scopes))}
+		for _, scope := range k.Scopes {
+			e.scopes[scope] = true
+		}
+		a.keys[k.Key] = e
+	}
+	return a
+}
+
+// Authenticate identifies the client that sent r. The key is taken from the
+// X-API-Key header or an "Authorization: Bearer" header.
+func (a *Authenticator) Authenticate(r *http.Request) (*Client, error) {
+	return a.authenticate(r, time.Now())
+}
+
+func (a *Authenticator) authenticate(r *http.Request, now time.Time) (*Client, error) {
+	key := r.Header.Get(KeyHeader)
+	if key == "" {
+		if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+			key = strings.TrimPrefix(h, "Bearer ")
+		}
+	}
+	if key == "" {
+		return nil, ErrMissingKey
+	}
+
+	e, ok := a.keys[key]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	if e.key.Disabled {
+		return nil, ErrRevokedKey
+	}
+
+	client := &Client{Label: e.key.Label, scopes: e.scopes}
+	if e.key.Secret == "" {
+		return client, nil
+	}
+
+	if err := a.verifySignature(r, e.key.Secret, now); err != nil {
+		return nil, err
+	}
+	client.Signed = true
+	return client, nil
+}
+
+func (a *Authenticator) verifySignature(r *http.Request, secret string, now time.Time) error {
+	signature := r.Header.Get(SignatureHeader)
+	if signature == "" {
+		return ErrMissingSignature
+	}
+
+	timestamp := r.Header.Get(TimestampHeader)
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrBadTimestamp
+	}
+	at := time.Unix(unix, 0)
+	if at.Before(now.Add(-a.maxSkew)) || at.After(now.Add(a.maxSkew)) {
+		return ErrBadTimestamp
+	}
+
+	body, err := readBody(r)
+	if err != nil {
+		return err
+	}
+	want := Sign(secret, r.Method, r.URL.EscapedPath(), r.URL.RawQuery, timestamp, body)
+	if !hmac.Equal([]byte(strings.ToLower(signature)), []byte(want)) {
+		return ErrBadSignature
+	}
+
+	//A request within the skew could still be replayed as is
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if now.Sub(a.swept) >= sweepInterval {
+		for sig, expires := range a.seen {
+			if now.After(expires) {
+				delete(a.seen, sig)
+			}
+		}
+		a.swept = now
+	}
+	if _, ok := a.seen[want]; ok {
+		return ErrReplayed
+	}
+	a.seen[want] = at.Add(a.maxSkew)
+	return nil
+}
+
+// readBody reads r's body, leaving it in place for the handler.
+func readBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxSignedBody+1))
+	r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxSignedBody {
+		return nil, ErrBodyTooLarge
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// Sign returns the hex signature of a request, as clients compute it. body
+// may be empty.
+func Sign(secret, method, path, rawQuery, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(method + "\n" + path + "\n" + rawQuery + "\n" + timestamp))
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		mac.Write([]byte("\n" + hex.EncodeToString(sum[:])))
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
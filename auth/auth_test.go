@@ -0,0 +1,218 @@
+package auth
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"weather-bff/config"
+)
+
+const (
+	plainKey  = "plain-key"
+	signedKey = "signed-key"
+	secret    = "s3cret"
+	maxSkew   = 5 * time.Minute
+)
+
+func newAuthenticator() *Authenticator {
+	return New(config.Auth{
+		Enabled: true,
+		MaxSkew: maxSkew,
+		Keys: []config.ClientKey{
+			{Label: "plain", Key: plainKey, Scopes: []string{"weather"}},
+			{Label: "signed", Key: signedKey, Secret: secret, Scopes: []string{"weather", "fact"}},
+			{Label: "revoked", Key: "revoked-key", Scopes: []string{"*"}, Disabled: true},
+		},
+	})
+}
+
+// signedRequest returns a request signed at at over body, which is then sent
+// as sentBody.
+func signedRequest(method, target, body, sentBody string, at time.Time) *http.Request {
+	r := httptest.NewRequest(method, target, strings.NewReader(sentBody))
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	r.Header.Set(KeyHeader, signedKey)
+	r.Header.Set(TimestampHeader, timestamp)
+	r.Header.Set(SignatureHeader, Sign(secret, method, r.URL.EscapedPath(), r.URL.RawQuery, timestamp, []byte(body)))
+	return r
+}
+
+func TestAuthenticate(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+
+	tests := []struct {
+		name    string
+		request func() *http.Request
+		scope   string
+		wantErr error
+		// wantAllowed is whether the client is granted scope.
+		wantAllowed bool
+	}{
+		{
+			name: "valid signature",
+			request: func() *http.Request {
+				return signedRequest("GET", "/current?q=london", "", "", now)
+			},
+			scope:       "weather",
+			wantAllowed: true,
+		},
+		{
+			name: "valid signature over a body",
+			request: func() *http.Request {
+				return signedRequest("POST", "/current", `{"q":"london"}`, `{"q":"london"}`, now)
+			},
+			scope:       "fact",
+			wantAllowed: true,
+		},
+		{
+			name: "tampered body",
+			request: func() *http.Request {
+				return signedRequest("POST", "/current", `{"q":"london"}`, `{"q":"paris"}`, now)
+			},
+			wantErr: ErrBadSignature,
+		},
+		{
+			name: "tampered query",
+			request: func() *http.Request {
+				r := signedRequest("GET", "/current?q=london", "", "", now)
+				r.URL.RawQuery = "q=paris"
+				return r
+			},
+			wantErr: ErrBadSignature,
+		},
+		{
+			name: "skew at the limit in the past",
+			request: func() *http.Request {
+				return signedRequest("GET", "/current", "", "", now.Add(-maxSkew))
+			},
+			scope:       "weather",
+			wantAllowed: true,
+		},
+		{
+			name: "skew at the limit in the future",
+			request: func() *http.Request {
+				return signedRequest("GET", "/current", "", "", now.Add(maxSkew))
+			},
+			scope:       "weather",
+			wantAllowed: true,
+		},
+		{
+			name: "skew beyond the limit in the past",
+			request: func() *http.Request {
+				return signedRequest("GET", "/current", "", "", now.Add(-maxSkew-time.Second))
+			},
+			wantErr: ErrBadTimestamp,
+		},
+		{
+			name: "skew beyond the limit in the future",
+			request: func() *http.Request {
+				return signedRequest("GET", "/current", "", "", now.Add(maxSkew+time.Second))
+			},
+			wantErr: ErrBadTimestamp,
+		},
+		{
+			name: "missing signature",
+			request: func() *http.Request {
+				r := signedRequest("GET", "/current", "", "", now)
+				r.Header.Del(SignatureHeader)
+				return r
+			},
+			wantErr: ErrMissingSignature,
+		},
+		{
+			name: "wrong scope",
+			request: func() *http.Request {
+				r := httptest.NewRequest("GET", "/debug/cache", nil)
+				r.Header.Set(KeyHeader, plainKey)
+				return r
+			},
+			scope:       "ops",
+			wantAllowed: false,
+		},
+		{
+			name: "bearer key",
+			request: func() *http.Request {
+				r := httptest.NewRequest("GET", "/current", nil)
+				r.Header.Set("Authorization", "Bearer "+plainKey)
+				return r
+			},
+			scope:       "weather",
+			wantAllowed: true,
+		},
+		{
+			name: "missing key",
+			request: func() *http.Request {
+				return httptest.NewRequest("GET", "/current", nil)
+			},
+			wantErr: ErrMissingKey,
+		},
+		{
+			name: "unknown key",
+			request: func() *http.Request {
+				r := httptest.NewRequest("GET", "/current", nil)
+				r.Header.Set(KeyHeader, "guess")
+				return r
+			},
+			wantErr: ErrUnknownKey,
+		},
+		{
+			name: "revoked key",
+			request: func() *http.Request {
+				r := httptest.NewRequest("GET", "/current", nil)
+				r.Header.Set(KeyHeader, "revoked-key")
+				return r
+			},
+			wantErr: ErrRevokedKey,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := newAuthenticator().authenticate(tt.request(), now)
+			if err != tt.wantErr {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := client.Allows(tt.scope); got != tt.wantAllowed {
+				t.Errorf("Allows(%q) = %v, want %v", tt.scope, got, tt.wantAllowed)
+			}
+		})
+	}
+}
+
+func TestReplayedRequestIsRejected(t *testing.T) {
+	a := newAuthenticator()
+	now := time.Unix(1700000000, 0)
+
+	first := signedRequest("GET", "/current?q=london", "", "", now)
+	replay := signedRequest("GET", "/current?q=london", "", "", now)
+	if _, err := a.authenticate(first, now); err != nil {
+		t.Fatalf("first request: %v", err)
+	}
+	if _, err := a.authenticate(replay, now.Add(time.Second)); err != ErrReplayed {
+		t.Fatalf("replayed request: err = %v, want %v", err, ErrReplayed)
+	}
+
+	//A new timestamp makes a new signature
+	again := signedRequest("GET", "/current?q=london", "", "", now.Add(time.Second))
+	if _, err := a.authenticate(again, now.Add(time.Second)); err != nil {
+		t.Errorf("request with a new timestamp: %v", err)
+	}
+}
+
+func TestBodyIsLeftForTheHandler(t *testing.T) {
+	r := signedRequest("POST", "/current", "payload", "payload", time.Unix(1700000000, 0))
+	if _, err := newAuthenticator().authenticate(r, time.Unix(1700000000, 0)); err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil || string(body) != "payload" {
+		t.Errorf("body after authentication = %q, %v; want %q", body, err, "payload")
+	}
+}
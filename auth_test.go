@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"weather-bff/auth"
+	"weather-bff/config"
+)
+
+func TestAuthMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	routeScopes = make(map[string]string)
+	router := gin.New()
+	router.Use(authMiddleware(router, auth.New(config.Auth{
+		Enabled: true,
+		Keys: []config.ClientKey{
+			{Label: "app", Key: "app-key", Scopes: []string{scopeWeather}},
+			{Label: "ops", Key: "ops-key", Scopes: []string{"*"}},
+		},
+	})))
+	ok := func(c *gin.Context) { c.String(http.StatusOK, "ok") }
+	route(router, "/healthz", scopePublic, ok)
+	route(router, "/current", scopeWeather, ok)
+	route(router, "/debug/cache", scopeOps, ok)
+	//Registered without going through route, so without a scope
+	router.GET("/forgotten", ok)
+
+	tests := []struct {
+		name string
+		path string
+		key  string
+		want int
+	}{
+		{"public route without a key", "/healthz", "", http.StatusOK},
+		{"missing key", "/current", "", http.StatusUnauthorized},
+		{"unknown key", "/current", "guess", http.StatusUnauthorized},
+		{"route in scope", "/current", "app-key", http.StatusOK},
+		{"wrong scope", "/debug/cache", "app-key", http.StatusForbidden},
+		{"wildcard scope", "/debug/cache", "ops-key", http.StatusOK},
+		{"route without a scope", "/forgotten", "ops-key", http.StatusForbidden},
+		{"unknown path without a key", "/nowhere", "", http.StatusUnauthorized},
+		{"unknown path with a key", "/nowhere", "app-key", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tt.path, nil)
+			if tt.key != "" {
+				r.Header.Set(auth.KeyHeader, tt.key)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
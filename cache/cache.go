@@ -0,0 +1,294 @@
+// Package cache provides a TTL cache with singleflight-style deduplication of
+// concurrent loads for the same key. Values are serialized into a Store, which
+// may be local to the process or shared between dynos. Expired entries are
+// kept for a while longer and served, stale, while they are refreshed in the
+// background, so a slow or failing upstream doesn't hold callers up.
+package cache
+
+import (
+	"context"
+	"encoding/binary"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LoadFunc produces the value for a key on a cache miss. It should give up
+// when ctx is done.
+type LoadFunc func(ctx context.Context) (interface{}, error)
+
+// Options configure a Cache.
+type Options struct {
+	// TTL is how long a value is fresh.
+	TTL time.Duration
+	// MaxStale is how long past its TTL a value is still served while a
+	// refresh runs. Zero disables stale serving.
+	MaxStale time.Duration
+	// RefreshTimeout bounds background refreshes, which outlive the request
+	// that started them.
+	RefreshTimeout time.Duration
+}
+
+// Result is a value from the cache.
+type Result struct {
+	Value interface{}
+	// AsOf is when the value was loaded, and Expires when it stops being
+	// fresh.
+	AsOf    time.Time
+	Expires time.Time
+	// Stale is set if the value is past its TTL.
+	Stale bool
+}
+
+// Stats is a snapshot of a Cache's counters.
+type Stats struct {
+	Hits       uint64 `json:"hits"`
+	Misses     uint64 `json:"misses"`
+	Shared     uint64 `json:"shared"`
+	Stale      uint64 `json:"stale"`
+	Refreshes  uint64 `json:"refreshes"`
+	Prefetches uint64 `json:"prefetches"`
+	TTL        string `json:"ttl"`
+	MaxStale   string `json:"maxStale"`
+}
+
+type entry struct {
+	value   interface{}
+	asOf    time.Time
+	expires time.Time
+}
+
+// call is an in-flight load that other callers for the same key wait on.
+// ctx is the context the load runs with.
+type call struct {
+	ctx   context.Context
+	done  chan struct{}
+	value interface{}
+	asOf  time.Time
+	err   error
+}
+
+// Cache holds values for a fixed TTL. Errors are never cached.
+type Cache struct {
+	store Store
+	codec Codec
+	opts  Options
+
+	mu    sync.Mutex
+	calls map[string]*call
+
+	hits       uint64
+	misses     uint64
+	shared     uint64
+	stale      uint64
+	refreshes  uint64
+	prefetches uint64
+}
+
+// New returns a Cache keeping values encoded with codec in store.
+func New(store Store, codec Codec, opts Options) *Cache {
+	return &Cache{
+		store: store,
+		codec: codec,
+		opts:  opts,
+		calls: make(map[string]*call),
+	}
+}
+
+// Key joins the parts identifying a cached upstream result, e.g.
+// Key("openweathermap", "weather", "10001", "metric", "de"). Variant holds
+// any request options that change the upstream payload.
+func Key(provider, endpoint, location string, variant ...string) string {
+	return strings.Join(append([]string{provider, endpoint, location}, variant...), ":")
+}
+
+// Fetch returns the cached value for key, calling load on a miss. Concurrent
+// misses for the same key share a single call to load, made with the context
+// of the first caller. If that caller is cancelled, callers still waiting
+// retry the load themselves rather than inherit its cancellation. Fetch
+// returns early with ctx's error once ctx is done.
+//
+// A value past its TTL but within MaxStale is returned right away, marked
+// stale, and reloaded in the background, with ctx's values but not its
+// deadline. If the reload fails, the stale value keeps being served until it
+// is too old.
+//
+// A store that can't be read counts as a miss, and one that can't be written
+// only costs later callers a load.
+func (c *Cache) Fetch(ctx context.Context, key string, load LoadFunc) (Result, error) {
+	for {
+		e, cached := c.get(ctx, key)
+		now := time.Now()
+		if cached && now.Before(e.expires) {
+			atomic.AddUint64(&c.hits, 1)
+			return e.result(false), nil
+		}
+		if cached && now.Before(e.expires.Add(c.opts.MaxStale)) {
+			atomic.AddUint64(&c.stale, 1)
+			c.refresh(ctx, key, load)
+			return e.result(true), nil
+		}
+
+		c.mu.Lock()
+		if cl, ok := c.calls[key]; ok {
+			c.mu.Unlock()
+			atomic.AddUint64(&c.shared, 1)
+			select {
+			case <-cl.done:
+			case <-ctx.Done():
+				return Result{}, ctx.Err()
+			}
+			if cl.err != nil && cl.ctx.Err() != nil && ctx.Err() == nil {
+				continue
+			}
+			return c.result(cl), cl.err
+		}
+		cl := &call{ctx: ctx, done: make(chan struct{})}
+		c.calls[key] = cl
+		c.mu.Unlock()
+
+		atomic.AddUint64(&c.misses, 1)
+		c.run(key, cl, load)
+		return c.result(cl), cl.err
+	}
+}
+
+// Prefetch loads key unless it holds a value that is still fresh for at least
+// ahead, so that callers keep finding fresh values. It reports whether it
+// loaded. Like Fetch, it shares a load already running for key.
+func (c *Cache) Prefetch(ctx context.Context, key string, ahead time.Duration, load LoadFunc) (Result, bool, error) {
+	e, cached := c.get(ctx, key)
+	if cached && time.Now().Add(ahead).Before(e.expires) {
+		return e.result(false), false, nil
+	}
+
+	c.mu.Lock()
+	if cl, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+		select {
+		case <-cl.done:
+		case <-ctx.Done():
+			return Result{}, false, ctx.Err()
+		}
+		return c.result(cl), false, cl.err
+	}
+	cl := &call{ctx: ctx, done: make(chan struct{})}
+	c.calls[key] = cl
+	c.mu.Unlock()
+
+	atomic.AddUint64(&c.prefetches, 1)
+	c.run(key, cl, load)
+	return c.result(cl), true, cl.err
+}
+
+func (c *Cache) result(cl *call) Result {
+	if cl.err != nil {
+		return Result{}
+	}
+	return Result{Value: cl.value, AsOf: cl.asOf, Expires: cl.asOf.Add(c.opts.TTL)}
+}
+
+func (e entry) result(stale bool) Result {
+	return Result{Value: e.value, AsOf: e.asOf, Expires: e.expires, Stale: stale}
+}
+
+// refresh reloads key in the background, unless a load for it is already
+// running.
+func (c *Cache) refresh(ctx context.Context, key string, load LoadFunc) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.calls[key]; ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(detached{ctx}, c.opts.RefreshTimeout)
+	cl := &call{ctx: ctx, done: make(chan struct{})}
+	c.calls[key] = cl
+	atomic.AddUint64(&c.refreshes, 1)
+
+	go func() {
+		defer cancel()
+		c.run(key, cl, load)
+	}()
+}
+
+// run makes the load for cl, stores its value and wakes up anyone waiting.
+func (c *Cache) run(key string, cl *call, load LoadFunc) {
+	cl.value, cl.err = load(cl.ctx)
+	if cl.err == nil {
+		cl.asOf = time.Now()
+		c.set(key, cl.value, cl.asOf)
+	}
+
+	c.mu.Lock()
+	delete(c.calls, key)
+	c.mu.Unlock()
+
+	close(cl.done)
+}
+
+// detached carries the values of a context, like its logger, but not its
+// deadline or cancellation.
+type detached struct {
+	context.Context
+}
+
+func (detached) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detached) Done() <-chan struct{}       { return nil }
+func (detached) Err() error                  { return nil }
+
+// Stats returns the current counters.
+func (c *Cache) Stats() Stats {
+	return Stats{
+		Hits:       atomic.LoadUint64(&c.hits),
+		Misses:     atomic.LoadUint64(&c.misses),
+		Shared:     atomic.LoadUint64(&c.shared),
+		Stale:      atomic.LoadUint64(&c.stale),
+		Refreshes:  atomic.LoadUint64(&c.refreshes),
+		Prefetches: atomic.LoadUint64(&c.prefetches),
+		TTL:        c.opts.TTL.String(),
+		MaxStale:   c.opts.MaxStale.String(),
+	}
+}
+
+// Entries are stored as a format version, the times the value was loaded and
+// expires, in Unix nanoseconds, and the encoded value. The store keeps them
+// until they are too old to serve even stale.
+const (
+	entryVersion   = 1
+	entryHeaderLen = 1 + 8 + 8
+)
+
+func (c *Cache) get(ctx context.Context, key string) (entry, bool) {
+	data, err := c.store.Get(ctx, key)
+	if err != nil || len(data) < entryHeaderLen || data[0] != entryVersion {
+		//Entries in another format, most likely from an older release, are
+		//treated as gone
+		return entry{}, false
+	}
+	value, err := c.codec.Unmarshal(data[entryHeaderLen:])
+	if err != nil {
+		return entry{}, false
+	}
+	return entry{
+		value:   value,
+		asOf:    time.Unix(0, int64(binary.BigEndian.Uint64(data[1:]))),
+		expires: time.Unix(0, int64(binary.BigEndian.Uint64(data[9:]))),
+	}, true
+}
+
+func (c *Cache) set(key string, value interface{}, asOf time.Time) {
+	encoded, err := c.codec.Marshal(value)
+	if err != nil {
+		return
+	}
+	data := make([]byte, entryHeaderLen, entryHeaderLen+len(encoded))
+	data[0] = entryVersion
+	binary.BigEndian.PutUint64(data[1:], uint64(asOf.UnixNano()))
+	binary.BigEndian.PutUint64(data[9:], uint64(asOf.Add(c.opts.TTL).UnixNano()))
+	data = append(data, encoded...)
+
+	//The value is worth keeping even if the caller that loaded it is gone
+	c.store.Set(context.Background(), key, data, c.opts.TTL+c.opts.MaxStale)
+}
@@ -0,0 +1,381 @@
+package cache
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type payload struct {
+	Name  string
+	Temps []float64
+	// Hidden is left out of API responses, but must survive the cache.
+	Hidden string `json:"-"`
+}
+
+func TestGobCodecRoundTrip(t *testing.T) {
+	codec := GobCodec(payload{})
+	in := payload{Name: "Paris", Temps: []float64{12.5, -3}, Hidden: "kept"}
+
+	data, err := codec.Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := codec.Unmarshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("round trip = %#v, want %#v", out, in)
+	}
+
+	if _, err := codec.Unmarshal([]byte("not gob")); err == nil {
+		t.Error("Unmarshal of garbage succeeded")
+	}
+}
+
+func TestEntryHeader(t *testing.T) {
+	store := NewMemoryStore()
+	c := New(store, GobCodec(payload{}), Options{TTL: time.Minute})
+	ctx := context.Background()
+
+	before := time.Now()
+	if _, err := c.Fetch(ctx, "k", loadPayload("Oslo")); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := store.Get(ctx, "k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) <= entryHeaderLen || data[0] != entryVersion {
+		t.Fatalf("entry = %q, want a version %d header and a value", data, entryVersion)
+	}
+	asOf := time.Unix(0, int64(binary.BigEndian.Uint64(data[1:])))
+	expires := time.Unix(0, int64(binary.BigEndian.Uint64(data[9:])))
+	if asOf.Before(before) || asOf.After(time.Now()) {
+		t.Errorf("asOf = %v, want the time of the load", asOf)
+	}
+	if got := expires.Sub(asOf); got != time.Minute {
+		t.Errorf("expires - asOf = %v, want the TTL", got)
+	}
+
+	res, err := c.Fetch(ctx, "k", failLoad(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.AsOf.Equal(asOf) || !res.Expires.Equal(expires) || res.Stale {
+		t.Errorf("cached result = %+v, want the times from the header", res)
+	}
+}
+
+func TestEntryOtherFormatIsMiss(t *testing.T) {
+	ctx := context.Background()
+	for name, data := range map[string][]byte{
+		"other version": append([]byte{entryVersion + 1}, make([]byte, entryHeaderLen)...),
+		"truncated":     {entryVersion, 0, 0},
+		"bad value":     append([]byte{entryVersion}, make([]byte, entryHeaderLen+3)...),
+	} {
+		store := NewMemoryStore()
+		store.Set(ctx, "k", data, time.Minute)
+		c := New(store, GobCodec(payload{}), Options{TTL: time.Minute})
+
+		res, err := c.Fetch(ctx, "k", loadPayload("Lima"))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if res.Value.(payload).Name != "Lima" {
+			t.Errorf("%s: got %+v, want a fresh load", name, res.Value)
+		}
+	}
+}
+
+func TestConcurrentMissesShareOneLoad(t *testing.T) {
+	c := New(NewMemoryStore(), GobCodec(payload{}), Options{TTL: time.Minute})
+	const callers = 20
+
+	var loads int32
+	release := make(chan struct{})
+	load := func(ctx context.Context) (interface{}, error) {
+		atomic.AddInt32(&loads, 1)
+		<-release
+		return payload{Name: "Berlin"}, nil
+	}
+
+	var wg sync.WaitGroup
+	results := make(chan Result, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := c.Fetch(context.Background(), "k", load)
+			if err != nil {
+				t.Error(err)
+			}
+			results <- res
+		}()
+	}
+	//Hold the load until every other caller is waiting on it
+	waitFor(t, func() bool { return c.Stats().Shared == callers-1 })
+	close(release)
+	wg.Wait()
+	close(results)
+
+	if n := atomic.LoadInt32(&loads); n != 1 {
+		t.Errorf("load called %d times, want once", n)
+	}
+	for res := range results {
+		if res.Value.(payload).Name != "Berlin" {
+			t.Errorf("caller got %+v, want the shared value", res.Value)
+		}
+	}
+	if stats := c.Stats(); stats.Misses != 1 {
+		t.Errorf("Stats = %+v, want a single miss", stats)
+	}
+}
+
+func TestFirstCallerCancelledOthersReload(t *testing.T) {
+	c := New(NewMemoryStore(), GobCodec(payload{}), Options{TTL: time.Minute})
+
+	firstCtx, cancel := context.WithCancel(context.Background())
+	started := make(chan struct{})
+	firstErr := make(chan error, 1)
+	go func() {
+		_, err := c.Fetch(firstCtx, "k", func(ctx context.Context) (interface{}, error) {
+			close(started)
+			<-ctx.Done()
+			return nil, ctx.Err()
+		})
+		firstErr <- err
+	}()
+	<-started
+
+	second := make(chan Result, 1)
+	go func() {
+		res, err := c.Fetch(context.Background(), "k", loadPayload("Rome"))
+		if err != nil {
+			t.Error(err)
+		}
+		second <- res
+	}()
+	waitFor(t, func() bool { return c.Stats().Shared == 1 })
+	cancel()
+
+	if err := <-firstErr; err != context.Canceled {
+		t.Errorf("cancelled caller got %v, want context.Canceled", err)
+	}
+	if res := <-second; res.Value == nil || res.Value.(payload).Name != "Rome" {
+		t.Errorf("waiting caller got %+v, want its own load", res.Value)
+	}
+}
+
+func TestLoadErrorsAreNotCached(t *testing.T) {
+	c := New(NewMemoryStore(), GobCodec(payload{}), Options{TTL: time.Minute})
+	ctx := context.Background()
+
+	errUpstream := errors.New("upstream down")
+	if _, err := c.Fetch(ctx, "k", func(ctx context.Context) (interface{}, error) {
+		return nil, errUpstream
+	}); err != errUpstream {
+		t.Fatalf("Fetch = %v, want the load error", err)
+	}
+	res, err := c.Fetch(ctx, "k", loadPayload("Dakar"))
+	if err != nil || res.Value.(payload).Name != "Dakar" {
+		t.Errorf("Fetch after an error = %+v, %v; want a new load", res.Value, err)
+	}
+}
+
+func TestCacheSharedThroughRedis(t *testing.T) {
+	srv, store := newTestRedis(t, "")
+	defer srv.Close()
+	defer store.Close()
+	ctx := context.Background()
+	opts := Options{TTL: 50 * time.Millisecond, MaxStale: time.Minute, RefreshTimeout: time.Second}
+
+	//Two dynos, each with its own Cache over the same Redis
+	first := New(store, GobCodec(payload{}), opts)
+	second := New(store, GobCodec(payload{}), opts)
+
+	if _, err := first.Fetch(ctx, "k", loadPayload("Cairo")); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := srv.TTL("test:k"); ttl <= opts.TTL || ttl > opts.TTL+opts.MaxStale {
+		t.Errorf("TTL in Redis = %v, want the TTL plus MaxStale", ttl)
+	}
+	res, err := second.Fetch(ctx, "k", failLoad(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Value.(payload).Name != "Cairo" || res.Stale {
+		t.Errorf("second dyno got %+v, want the fresh value the first stored", res)
+	}
+
+	//Past the TTL, the value is served stale and refreshed in the background
+	time.Sleep(opts.TTL)
+	refreshed := make(chan struct{})
+	res, err = second.Fetch(ctx, "k", func(ctx context.Context) (interface{}, error) {
+		defer close(refreshed)
+		return payload{Name: "Cairo, refreshed"}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Value.(payload).Name != "Cairo" || !res.Stale {
+		t.Errorf("after the TTL got %+v, want the old value marked stale", res)
+	}
+	<-refreshed
+	waitFor(t, func() bool {
+		e, ok := first.get(ctx, "k")
+		return ok && e.value.(payload).Name == "Cairo, refreshed"
+	})
+	res, err = first.Fetch(ctx, "k", failLoad(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Stale {
+		t.Errorf("after the refresh got %+v, want it fresh", res)
+	}
+}
+
+func TestStaleServedWhileRefreshFails(t *testing.T) {
+	opts := Options{TTL: 20 * time.Millisecond, MaxStale: time.Minute, RefreshTimeout: time.Second}
+	c := New(NewMemoryStore(), GobCodec(payload{}), opts)
+	ctx := context.Background()
+
+	if _, err := c.Fetch(ctx, "k", loadPayload("Lagos")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(opts.TTL)
+
+	var refreshes int32
+	failing := func(ctx context.Context) (interface{}, error) {
+		atomic.AddInt32(&refreshes, 1)
+		return nil, errors.New("upstream down")
+	}
+	for i := 0; i < 3; i++ {
+		res, err := c.Fetch(ctx, "k", failing)
+		if err != nil {
+			t.Fatalf("Fetch #%d with the upstream down: %v", i+1, err)
+		}
+		if res.Value.(payload).Name != "Lagos" || !res.Stale {
+			t.Fatalf("Fetch #%d = %+v, want the old value marked stale", i+1, res)
+		}
+		//Let the failed refresh finish, so the next Fetch starts another
+		waitFor(t, func() bool { return atomic.LoadInt32(&refreshes) == int32(i+1) })
+		waitFor(t, func() bool {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			return len(c.calls) == 0
+		})
+	}
+}
+
+func TestStalePastMaxStaleIsMiss(t *testing.T) {
+	opts := Options{TTL: 10 * time.Millisecond, MaxStale: 20 * time.Millisecond, RefreshTimeout: time.Second}
+	c := New(NewMemoryStore(), GobCodec(payload{}), opts)
+	ctx := context.Background()
+
+	if _, err := c.Fetch(ctx, "k", loadPayload("Lagos")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(opts.TTL + opts.MaxStale)
+
+	//Too old to serve: the caller waits for the load, and gets its error
+	errUpstream := errors.New("upstream down")
+	res, err := c.Fetch(ctx, "k", func(ctx context.Context) (interface{}, error) {
+		return nil, errUpstream
+	})
+	if err != errUpstream || res.Value != nil {
+		t.Fatalf("Fetch past MaxStale = %+v, %v; want the load error", res, err)
+	}
+	res, err = c.Fetch(ctx, "k", loadPayload("Accra"))
+	if err != nil || res.Value.(payload).Name != "Accra" || res.Stale {
+		t.Errorf("Fetch past MaxStale = %+v, %v; want a fresh load", res, err)
+	}
+}
+
+func TestRefreshOutlivesRequest(t *testing.T) {
+	opts := Options{TTL: 20 * time.Millisecond, MaxStale: time.Minute, RefreshTimeout: time.Second}
+	c := New(NewMemoryStore(), GobCodec(payload{}), opts)
+
+	if _, err := c.Fetch(context.Background(), "k", loadPayload("Lagos")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(opts.TTL)
+
+	type ctxKey struct{}
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), ctxKey{}, "req-1"), time.Hour)
+	release := make(chan struct{})
+	refreshErr := make(chan error, 1)
+	res, err := c.Fetch(ctx, "k", func(ctx context.Context) (interface{}, error) {
+		<-release
+		if ctx.Value(ctxKey{}) != "req-1" {
+			t.Error("refresh lost the request's values")
+		}
+		if deadline, ok := ctx.Deadline(); !ok || time.Until(deadline) > opts.RefreshTimeout {
+			t.Errorf("refresh deadline = %v, %v; want RefreshTimeout, not the request's", deadline, ok)
+		}
+		refreshErr <- ctx.Err()
+		return payload{Name: "Lagos, refreshed"}, nil
+	})
+	if err != nil || !res.Stale {
+		t.Fatalf("Fetch = %+v, %v; want the stale value", res, err)
+	}
+
+	//The request is over before the refresh gets going
+	cancel()
+	close(release)
+	if err := <-refreshErr; err != nil {
+		t.Fatalf("refresh context ended with the request: %v", err)
+	}
+	waitFor(t, func() bool {
+		e, ok := c.get(context.Background(), "k")
+		return ok && e.value.(payload).Name == "Lagos, refreshed"
+	})
+}
+
+func TestCacheRedisDown(t *testing.T) {
+	srv, store := newTestRedis(t, "")
+	defer store.Close()
+	srv.Close()
+	c := New(store, GobCodec(payload{}), Options{TTL: time.Minute})
+
+	//An unreachable store is a miss, and the load still answers
+	res, err := c.Fetch(context.Background(), "k", loadPayload("Quito"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Value.(payload).Name != "Quito" {
+		t.Errorf("got %+v, want the loaded value", res.Value)
+	}
+}
+
+func loadPayload(name string) LoadFunc {
+	return func(ctx context.Context) (interface{}, error) {
+		return payload{Name: name}, nil
+	}
+}
+
+func failLoad(t *testing.T) LoadFunc {
+	return func(ctx context.Context) (interface{}, error) {
+		t.Error("unexpected load")
+		return nil, context.Canceled
+	}
+}
+
+// waitFor polls cond for up to a second.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met within a second")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
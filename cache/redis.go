@@ -0,0 +1,302 @@
+package cache
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Defaults for RedisStore. Cache lookups sit in front of every upstream call,
+// so a slow Redis must fail fast rather than hold requests up.
+const (
+	redisTimeout  = 500 * time.Millisecond
+	redisMaxIdle  = 8
+	redisProtoMax = 64 << 20
+)
+
+// RedisError is an error reply from Redis.
+type RedisError string
+
+func (e RedisError) Error() string {
+	return "redis: " + string(e)
+}
+
+var errRedisProtocol = errors.New("redis: protocol error")
+
+// RedisStore is a Store in Redis, speaking RESP over a small pool of
+// connections. Keys are prefixed with a namespace.
+type RedisStore struct {
+	addr      string
+	username  string
+	password  string
+	db        int
+	tls       *tls.Config
+	namespace string
+	timeout   time.Duration
+
+	idle chan *redisConn
+}
+
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+// NewRedisStore returns a RedisStore for the server at rawURL, of the form
+// redis://[user:password@]host[:port][/db], or rediss:// for TLS. Keys are
+// stored as namespace:key. Connections are made as needed.
+func NewRedisStore(rawURL, namespace string) (*RedisStore, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.New("redis: invalid URL")
+	}
+
+	s := &RedisStore{
+		addr:      u.Host,
+		namespace: namespace,
+		timeout:   redisTimeout,
+		idle:      make(chan *redisConn, redisMaxIdle),
+	}
+	switch u.Scheme {
+	case "redis":
+	case "rediss":
+		s.tls = &tls.Config{ServerName: u.Hostname()}
+	default:
+		return nil, fmt.Errorf("redis: unsupported scheme %q", u.Scheme)
+	}
+	if u.Port() == "" {
+		s.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		s.username = u.User.Username()
+		s.password, _ = u.User.Password()
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		if s.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("redis: invalid database %q", db)
+		}
+	}
+	return s, nil
+}
+
+// Get implements Store.
+func (s *RedisStore) Get(ctx context.Context, key string) ([]byte, error) {
+	reply, err := s.do(ctx, "GET", s.namespace+":"+key)
+	if err != nil {
+		return nil, err
+	}
+	if reply == nil {
+		return nil, ErrNotFound
+	}
+	value, ok := reply.([]byte)
+	if !ok {
+		return nil, errRedisProtocol
+	}
+	return value, nil
+}
+
+// Set implements Store.
+func (s *RedisStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	ms := int64(ttl / time.Millisecond)
+	if ms < 1 {
+		ms = 1
+	}
+	_, err := s.do(ctx, "SET", s.namespace+":"+key, string(value), "PX", strconv.FormatInt(ms, 10))
+	return err
+}
+
+// Incr adds n to the integer stored under key, creating it to expire after
+// ttl if needed, and returns the result. It makes RedisStore a
+// quota.Counter, so every dyno spends from the same quota.
+func (s *RedisStore) Incr(ctx context.Context, key string, n int64, ttl time.Duration) (int64, error) {
+	key = s.namespace + ":" + key
+	reply, err := s.do(ctx, "INCRBY", key, strconv.FormatInt(n, 10))
+	if err != nil {
+		return 0, err
+	}
+	count, ok := reply.(int64)
+	if !ok {
+		return 0, errRedisProtocol
+	}
+	//Only the first increment creates the key. Counts are per window, so
+	//one that misses its expiry is just left unused
+	if count == n {
+		ms := int64(ttl / time.Millisecond)
+		if ms < 1 {
+			ms = 1
+		}
+		if _, err := s.do(ctx, "PEXPIRE", key, strconv.FormatInt(ms, 10)); err != nil {
+			return 0, err
+		}
+	}
+	return count, nil
+}
+
+// Ping checks that Redis answers.
+func (s *RedisStore) Ping(ctx context.Context) error {
+	_, err := s.do(ctx, "PING")
+	return err
+}
+
+// Close closes the idle connections.
+func (s *RedisStore) Close() error {
+	for {
+		select {
+		case c := <-s.idle:
+			c.conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// do sends a command and returns its reply: nil, a string for simple
+// strings, an int64, []byte for bulk strings or []interface{} for arrays.
+// Error replies are returned as a RedisError.
+func (s *RedisStore) do(ctx context.Context, args ...string) (interface{}, error) {
+	deadline := time.Now().Add(s.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+
+	for {
+		c, reused, err := s.conn(ctx, deadline)
+		if err != nil {
+			return nil, err
+		}
+		c.conn.SetDeadline(deadline)
+
+		reply, err := c.roundTrip(args...)
+		if _, ok := err.(RedisError); err != nil && !ok {
+			//The connection may be mid-reply; don't reuse it
+			c.conn.Close()
+			//Servers close idle connections, so an old one failing says
+			//little; try a new one before giving up
+			if reused && time.Now().Before(deadline) {
+				continue
+			}
+			return nil, err
+		}
+		s.release(c)
+		return reply, err
+	}
+}
+
+// conn returns an idle connection, reporting that it was reused, or else
+// dials a new one.
+func (s *RedisStore) conn(ctx context.Context, deadline time.Time) (*redisConn, bool, error) {
+	select {
+	case c := <-s.idle:
+		return c, true, nil
+	default:
+	}
+
+	dialer := net.Dialer{Deadline: deadline}
+	conn, err := dialer.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return nil, false, err
+	}
+	if s.tls != nil {
+		conn = tls.Client(conn, s.tls)
+	}
+	conn.SetDeadline(deadline)
+	c := &redisConn{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+
+	var setup [][]string
+	switch {
+	case s.username != "":
+		setup = append(setup, []string{"AUTH", s.username, s.password})
+	case s.password != "":
+		setup = append(setup, []string{"AUTH", s.password})
+	}
+	if s.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(s.db)})
+	}
+	for _, args := range setup {
+		if _, err := c.roundTrip(args...); err != nil {
+			conn.Close()
+			return nil, false, err
+		}
+	}
+	return c, false, nil
+}
+
+func (s *RedisStore) release(c *redisConn) {
+	select {
+	case s.idle <- c:
+	default:
+		c.conn.Close()
+	}
+}
+
+func (c *redisConn) roundTrip(args ...string) (interface{}, error) {
+	fmt.Fprintf(c.w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(c.w, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+	return readReply(c.r)
+}
+
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, errRedisProtocol
+	}
+	kind, line := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return line, nil
+	case '-':
+		return nil, RedisError(line)
+	case ':':
+		return strconv.ParseInt(line, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line)
+		if err != nil || n > redisProtoMax {
+			return nil, errRedisProtocol
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line)
+		if err != nil || n > redisProtoMax {
+			return nil, errRedisProtocol
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = readReply(r); err != nil {
+				if _, ok := err.(RedisError); !ok {
+					return nil, err
+				}
+				items[i] = err
+			}
+		}
+		return items, nil
+	}
+	return nil, errRedisProtocol
+}
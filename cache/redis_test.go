@@ -0,0 +1,142 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"weather-bff/cache/redistest"
+)
+
+func newTestRedis(t *testing.T, password string) (*redistest.Server, *RedisStore) {
+	t.Helper()
+	srv, err := redistest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.SetPassword(password)
+	store, err := NewRedisStore(srv.URL()+"/2", "test")
+	if err != nil {
+		srv.Close()
+		t.Fatal(err)
+	}
+	return srv, store
+}
+
+func TestRedisStoreRoundTrip(t *testing.T) {
+	srv, store := newTestRedis(t, "s3cret")
+	defer srv.Close()
+	defer store.Close()
+	ctx := context.Background()
+
+	if _, err := store.Get(ctx, "missing"); err != ErrNotFound {
+		t.Fatalf("Get of a missing key: got %v, want ErrNotFound", err)
+	}
+
+	//Values are binary, so make sure nothing is mangled on the wire
+	value := []byte("gob\x00\r\n$-1\r\n\xff")
+	if err := store.Set(ctx, "openweathermap:weather:10001", value, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.Get(ctx, "openweathermap:weather:10001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, value) {
+		t.Errorf("Get = %q, want %q", got, value)
+	}
+
+	if keys := srv.Keys(); len(keys) != 1 || keys[0] != "test:openweathermap:weather:10001" {
+		t.Errorf("keys in Redis = %q, want the key under the namespace", keys)
+	}
+	commands := srv.Commands()
+	if commands["AUTH"] != 1 || commands["SELECT"] != 1 {
+		t.Errorf("AUTH and SELECT should be sent once, on the pooled connection: %v", commands)
+	}
+}
+
+func TestRedisStoreWrongPassword(t *testing.T) {
+	srv, err := redistest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.SetPassword("right")
+
+	store, err := NewRedisStore("redis://:wrong@"+srv.Addr(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.Get(context.Background(), "k")
+	if _, ok := err.(RedisError); !ok {
+		t.Fatalf("Get with a wrong password: got %v, want a RedisError", err)
+	}
+}
+
+func TestRedisStoreTTL(t *testing.T) {
+	srv, store := newTestRedis(t, "")
+	defer srv.Close()
+	defer store.Close()
+	ctx := context.Background()
+
+	if err := store.Set(ctx, "k", []byte("v"), 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := srv.TTL("test:k"); ttl <= 0 || ttl > 50*time.Millisecond {
+		t.Errorf("TTL in Redis = %v, want up to 50ms", ttl)
+	}
+	if _, err := store.Get(ctx, "k"); err != nil {
+		t.Fatalf("Get before expiry: %v", err)
+	}
+
+	time.Sleep(80 * time.Millisecond)
+	if _, err := store.Get(ctx, "k"); err != ErrNotFound {
+		t.Fatalf("Get after expiry: got %v, want ErrNotFound", err)
+	}
+}
+
+func TestRedisStoreIncr(t *testing.T) {
+	srv, store := newTestRedis(t, "")
+	defer srv.Close()
+	defer store.Close()
+	ctx := context.Background()
+
+	for i, want := range []int64{1, 2, 7} {
+		n := int64(1)
+		if i == 2 {
+			n = 5
+		}
+		got, err := store.Incr(ctx, "quota:k", n, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("Incr #%d = %d, want %d", i+1, got, want)
+		}
+	}
+	if ttl := srv.TTL("test:quota:k"); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("TTL in Redis = %v, want up to a minute", ttl)
+	}
+	if n := srv.Commands()["PEXPIRE"]; n != 1 {
+		t.Errorf("PEXPIRE sent %d times, want only on creation", n)
+	}
+}
+
+func TestRedisStoreServerDown(t *testing.T) {
+	srv, store := newTestRedis(t, "")
+	defer store.Close()
+	ctx := context.Background()
+
+	if err := store.Set(ctx, "k", []byte("v"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	srv.Close()
+
+	if _, err := store.Get(ctx, "k"); err == nil || err == ErrNotFound {
+		t.Fatalf("Get with Redis down: got %v, want a connection error", err)
+	}
+	if err := store.Set(ctx, "k", []byte("v"), time.Minute); err == nil {
+		t.Fatal("Set with Redis down succeeded")
+	}
+}
@@ -0,0 +1,418 @@
+// Package redistest provides an in-process stand-in for Redis, speaking just
+// enough RESP for cache.RedisStore: PING, AUTH, SELECT, GET, SET with EX or
+// PX, INCRBY, PEXPIRE, DEL, PTTL, FLUSHALL and QUIT. Use it to exercise the
+// Redis cache and quota counters without a server:
+//
+//	srv, err := redistest.NewServer()
+//	...
+//	defer srv.Close()
+//	store, err := cache.NewRedisStore(srv.URL(), "test")
+package redistest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server is an in-memory Redis listening on a local port.
+type Server struct {
+	ln net.Listener
+
+	mu       sync.Mutex
+	password string
+	data     map[string]item
+	conns    map[net.Conn]bool
+	commands map[string]int
+	closed   bool
+}
+
+type item struct {
+	value   string
+	expires time.Time // zero if the key doesn't expire
+}
+
+// NewServer starts a Server on a random port of 127.0.0.1.
+func NewServer() (*Server, error) {
+	return NewServerAt("127.0.0.1:0")
+}
+
+// NewServerAt starts a Server listening on addr, e.g. the address of one
+// that was closed, to bring Redis back empty.
+func NewServerAt(addr string) (*Server, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		ln:       ln,
+		data:     make(map[string]item),
+		conns:    make(map[net.Conn]bool),
+		commands: make(map[string]int),
+	}
+	go s.serve()
+	return s, nil
+}
+
+// Addr returns the address s listens on.
+func (s *Server) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// SetPassword makes connections made from now on send password with AUTH.
+func (s *Server) SetPassword(password string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.password = password
+}
+
+// URL returns a redis:// URL for s, with the password if one is set.
+func (s *Server) URL() string {
+	s.mu.Lock()
+	password := s.password
+	s.mu.Unlock()
+
+	if password != "" {
+		return "redis://:" + password + "@" + s.Addr()
+	}
+	return "redis://" + s.Addr()
+}
+
+// Close stops s and drops every connection, as if Redis went away.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+	return s.ln.Close()
+}
+
+// Get returns the value of key, if it is set and not expired.
+func (s *Server) Get(key string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	it, ok := s.lookupLocked(key, time.Now())
+	return it.value, ok
+}
+
+// TTL returns how long key has left, or 0 if it is unset or doesn't expire.
+func (s *Server) TTL(key string) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	it, ok := s.lookupLocked(key, time.Now())
+	if !ok || it.expires.IsZero() {
+		return 0
+	}
+	return time.Until(it.expires)
+}
+
+// Keys returns every live key, sorted.
+func (s *Server) Keys() []string {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var keys []string
+	for k := range s.data {
+		if _, ok := s.lookupLocked(k, now); ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Commands returns how many times each command, in upper case, was received.
+func (s *Server) Commands() map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counts := make(map[string]int, len(s.commands))
+	for cmd, n := range s.commands {
+		counts[cmd] = n
+	}
+	return counts
+}
+
+func (s *Server) lookupLocked(key string, now time.Time) (item, bool) {
+	it, ok := s.data[key]
+	if ok && !it.expires.IsZero() && !now.Before(it.expires) {
+		delete(s.data, key)
+		return item{}, false
+	}
+	return it, ok
+}
+
+func (s *Server) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = true
+		s.mu.Unlock()
+
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	s.mu.Lock()
+	password := s.password
+	s.mu.Unlock()
+	authed := password == ""
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			if err != io.EOF {
+				writeError(w, "ERR Protocol error: "+err.Error())
+				w.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		cmd := strings.ToUpper(args[0])
+		s.mu.Lock()
+		s.commands[cmd]++
+		s.mu.Unlock()
+
+		switch {
+		case cmd == "QUIT":
+			writeSimple(w, "OK")
+			w.Flush()
+			return
+		case cmd == "AUTH":
+			//AUTH password, or AUTH username password since Redis 6
+			if len(args) < 2 || args[len(args)-1] != password {
+				writeError(w, "WRONGPASS invalid username-password pair")
+				break
+			}
+			authed = true
+			writeSimple(w, "OK")
+		case !authed:
+			writeError(w, "NOAUTH Authentication required.")
+		default:
+			s.exec(w, cmd, args[1:])
+		}
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) exec(w *bufio.Writer, cmd string, args []string) {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch cmd {
+	case "PING":
+		writeSimple(w, "PONG")
+	case "SELECT":
+		if len(args) != 1 {
+			writeArity(w, cmd)
+			return
+		}
+		if _, err := strconv.Atoi(args[0]); err != nil {
+			writeError(w, "ERR invalid DB index")
+			return
+		}
+		writeSimple(w, "OK")
+	case "GET":
+		if len(args) != 1 {
+			writeArity(w, cmd)
+			return
+		}
+		it, ok := s.lookupLocked(args[0], now)
+		if !ok {
+			w.WriteString("$-1\r\n")
+			return
+		}
+		writeBulk(w, it.value)
+	case "SET":
+		if len(args) != 2 && len(args) != 4 {
+			writeError(w, "ERR syntax error")
+			return
+		}
+		it := item{value: args[1]}
+		if len(args) == 4 {
+			n, err := strconv.ParseInt(args[3], 10, 64)
+			if err != nil || n <= 0 {
+				writeError(w, "ERR invalid expire time in 'set' command")
+				return
+			}
+			switch strings.ToUpper(args[2]) {
+			case "EX":
+				it.expires = now.Add(time.Duration(n) * time.Second)
+			case "PX":
+				it.expires = now.Add(time.Duration(n) * time.Millisecond)
+			default:
+				writeError(w, "ERR syntax error")
+				return
+			}
+		}
+		s.data[args[0]] = it
+		writeSimple(w, "OK")
+	case "INCRBY":
+		if len(args) != 2 {
+			writeArity(w, cmd)
+			return
+		}
+		by, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			writeError(w, "ERR value is not an integer or out of range")
+			return
+		}
+		it, _ := s.lookupLocked(args[0], now)
+		n := int64(0)
+		if it.value != "" {
+			if n, err = strconv.ParseInt(it.value, 10, 64); err != nil {
+				writeError(w, "ERR value is not an integer or out of range")
+				return
+			}
+		}
+		n += by
+		it.value = strconv.FormatInt(n, 10)
+		s.data[args[0]] = it
+		fmt.Fprintf(w, ":%d\r\n", n)
+	case "PEXPIRE":
+		if len(args) != 2 {
+			writeArity(w, cmd)
+			return
+		}
+		ms, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			writeError(w, "ERR value is not an integer or out of range")
+			return
+		}
+		it, ok := s.lookupLocked(args[0], now)
+		if !ok {
+			w.WriteString(":0\r\n")
+			return
+		}
+		it.expires = now.Add(time.Duration(ms) * time.Millisecond)
+		s.data[args[0]] = it
+		w.WriteString(":1\r\n")
+	case "DEL":
+		if len(args) == 0 {
+			writeArity(w, cmd)
+			return
+		}
+		n := 0
+		for _, k := range args {
+			if _, ok := s.lookupLocked(k, now); ok {
+				delete(s.data, k)
+				n++
+			}
+		}
+		fmt.Fprintf(w, ":%d\r\n", n)
+	case "PTTL":
+		if len(args) != 1 {
+			writeArity(w, cmd)
+			return
+		}
+		it, ok := s.lookupLocked(args[0], now)
+		switch {
+		case !ok:
+			w.WriteString(":-2\r\n")
+		case it.expires.IsZero():
+			w.WriteString(":-1\r\n")
+		default:
+			fmt.Fprintf(w, ":%d\r\n", it.expires.Sub(now)/time.Millisecond)
+		}
+	case "FLUSHALL", "FLUSHDB":
+		s.data = make(map[string]item)
+		writeSimple(w, "OK")
+	default:
+		writeError(w, fmt.Sprintf("ERR unknown command '%s'", cmd))
+	}
+}
+
+// readCommand reads a command sent as an array of bulk strings, as clients
+// do.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		return nil, fmt.Errorf("expected '*', got %q", line)
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid multibulk length")
+	}
+
+	args := make([]string, n)
+	for i := range args {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, fmt.Errorf("expected '$', got %q", line)
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("invalid bulk length")
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), nil
+}
+
+func writeSimple(w *bufio.Writer, s string) {
+	w.WriteString("+" + s + "\r\n")
+}
+
+func writeError(w *bufio.Writer, msg string) {
+	w.WriteString("-" + msg + "\r\n")
+}
+
+func writeBulk(w *bufio.Writer, s string) {
+	fmt.Fprintf(w, "$%d\r\n%s\r\n", len(s), s)
+}
+
+func writeArity(w *bufio.Writer, cmd string) {
+	writeError(w, fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(cmd)))
+}
@@ -0,0 +1,242 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"reflect"
+	"sync"
+	"time"
+
+	"weather-bff/logging"
+)
+
+// ErrNotFound is returned by Store.Get for keys it doesn't hold.
+var ErrNotFound = errors.New("cache: key not found")
+
+// Store holds serialized entries by key.
+type Store interface {
+	// Get returns the value stored under key, or ErrNotFound.
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Set stores value under key for ttl.
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+}
+
+// Codec converts cached values to and from bytes.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte) (interface{}, error)
+}
+
+type gobCodec struct {
+	typ reflect.Type
+}
+
+// GobCodec returns a Codec encoding values of the same type as sample with
+// encoding/gob. Unlike JSON, it keeps every exported field, including those
+// hidden from API responses with `json:"-"`.
+func GobCodec(sample interface{}) Codec {
+	return gobCodec{typ: reflect.TypeOf(sample)}
+}
+
+func (c gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c gobCodec) Unmarshal(data []byte) (interface{}, error) {
+	v := reflect.New(c.typ)
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(v.Interface()); err != nil {
+		return nil, err
+	}
+	return v.Elem().Interface(), nil
+}
+
+// MemoryStore is a Store local to the process.
+type MemoryStore struct {
+	mu      sync.Mutex
+	entries map[string]memoryEntry
+	swept   time.Time
+}
+
+type memoryEntry struct {
+	value   []byte
+	expires time.Time
+}
+
+// sweepInterval is how often MemoryStore drops expired entries.
+const sweepInterval = time.Minute
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{entries: make(map[string]memoryEntry), swept: time.Now()}
+}
+
+// Get implements Store.
+func (s *MemoryStore) Get(ctx context.Context, key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[key]
+	if !ok || !time.Now().Before(e.expires) {
+		return nil, ErrNotFound
+	}
+	return e.value, nil
+}
+
+// Set implements Store.
+func (s *MemoryStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries[key] = memoryEntry{value: value, expires: now.Add(ttl)}
+	if now.Sub(s.swept) >= sweepInterval {
+		for k, e := range s.entries {
+			if !now.Before(e.expires) {
+				delete(s.entries, k)
+			}
+		}
+		s.swept = now
+	}
+	return nil
+}
+
+// FallbackStore uses a primary Store, such as Redis, and falls back to a
+// secondary one while the primary fails. The primary is tried again after
+// retryInterval, so an outage costs each request at most one failed call.
+type FallbackStore struct {
+	primary, secondary Store
+	name               string
+
+	mu        sync.Mutex
+	downSince time.Time
+	retryAt   time.Time
+	lastErr   error
+}
+
+// retryInterval is how long FallbackStore stays on the secondary store after
+// the primary fails. Tests shorten it.
+var retryInterval = 10 * time.Second
+
+// FallbackStatus is a snapshot of a FallbackStore.
+type FallbackStatus struct {
+	Primary string `json:"primary"`
+	// Down is set while the secondary store is in use.
+	Down      bool       `json:"down"`
+	DownSince *time.Time `json:"downSince,omitempty"`
+	LastError string     `json:"lastError,omitempty"`
+}
+
+// NewFallbackStore returns a FallbackStore over primary, named name in logs,
+// and secondary.
+func NewFallbackStore(name string, primary, secondary Store) *FallbackStore {
+	return &FallbackStore{primary: primary, secondary: secondary, name: name}
+}
+
+// Get implements Store.
+func (s *FallbackStore) Get(ctx context.Context, key string) ([]byte, error) {
+	if s.usePrimary() {
+		value, err := s.primary.Get(ctx, key)
+		switch {
+		case err == nil || err == ErrNotFound:
+			s.succeeded()
+			return value, err
+		case ctx.Err() != nil:
+			//The caller gave up, which says nothing about the store
+			return nil, err
+		}
+		s.failed(err)
+	}
+	return s.secondary.Get(ctx, key)
+}
+
+// Set implements Store.
+func (s *FallbackStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if s.usePrimary() {
+		err := s.primary.Set(ctx, key, value, ttl)
+		switch {
+		case err == nil:
+			s.succeeded()
+			return nil
+		case ctx.Err() != nil:
+			return err
+		}
+		s.failed(err)
+	}
+	return s.secondary.Set(ctx, key, value, ttl)
+}
+
+// Pinger is a Store that can check it is reachable without a key.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// Ping checks the primary store, if it is a Pinger, and records the outcome
+// like any other call, so Status is current even while the store is idle. A
+// successful Ping during an outage switches back to the primary store early.
+func (s *FallbackStore) Ping(ctx context.Context) error {
+	p, ok := s.primary.(Pinger)
+	if !ok {
+		return nil
+	}
+	err := p.Ping(ctx)
+	switch {
+	case err == nil:
+		s.succeeded()
+	case ctx.Err() == nil:
+		s.failed(err)
+	}
+	return err
+}
+
+// Status returns whether the primary store is in use.
+func (s *FallbackStore) Status() FallbackStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := FallbackStatus{Primary: s.name}
+	if !s.downSince.IsZero() {
+		since := s.downSince
+		status.Down = true
+		status.DownSince = &since
+		status.LastError = s.lastErr.Error()
+	}
+	return status
+}
+
+func (s *FallbackStore) usePrimary() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.downSince.IsZero() || !time.Now().Before(s.retryAt)
+}
+
+func (s *FallbackStore) succeeded() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.downSince.IsZero() {
+		logging.Default().Info("cache store recovered", "store", s.name, "down_ms", time.Since(s.downSince))
+		s.downSince = time.Time{}
+		s.lastErr = nil
+	}
+}
+
+func (s *FallbackStore) failed(err error) {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.downSince.IsZero() {
+		logging.Default().Warn("cache store failed, using local memory", "store", s.name, "error", err)
+		s.downSince = now
+	}
+	s.retryAt = now.Add(retryInterval)
+	s.lastErr = err
+}
@@ -0,0 +1,141 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"weather-bff/cache/redistest"
+)
+
+func TestMemoryStoreExpiry(t *testing.T) {
+	store := NewMemoryStore()
+	ctx := context.Background()
+
+	store.Set(ctx, "k", []byte("v"), 30*time.Millisecond)
+	if got, err := store.Get(ctx, "k"); err != nil || string(got) != "v" {
+		t.Fatalf("Get = %q, %v; want v", got, err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, err := store.Get(ctx, "k"); err != ErrNotFound {
+		t.Fatalf("Get after expiry: got %v, want ErrNotFound", err)
+	}
+}
+
+func TestFallbackStoreOutageAndRecovery(t *testing.T) {
+	defer func(d time.Duration) { retryInterval = d }(retryInterval)
+	retryInterval = 50 * time.Millisecond
+
+	srv, redis := newTestRedis(t, "")
+	defer redis.Close()
+	local := NewMemoryStore()
+	store := NewFallbackStore("redis", redis, local)
+	ctx := context.Background()
+
+	if err := store.Set(ctx, "before", []byte("shared"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := srv.Get("test:before"); !ok {
+		t.Fatal("value not written to Redis")
+	}
+	if status := store.Status(); status.Down {
+		t.Fatalf("Status with Redis up = %+v", status)
+	}
+
+	//Redis goes away: writes and reads carry on in memory
+	addr := srv.Addr()
+	srv.Close()
+	if err := store.Set(ctx, "during", []byte("local"), time.Minute); err != nil {
+		t.Fatalf("Set during the outage: %v", err)
+	}
+	status := store.Status()
+	if !status.Down || status.DownSince == nil || status.LastError == "" {
+		t.Fatalf("Status during the outage = %+v, want down with the error", status)
+	}
+	if got, err := store.Get(ctx, "during"); err != nil || string(got) != "local" {
+		t.Fatalf("Get during the outage = %q, %v; want the value kept in memory", got, err)
+	}
+	if _, err := local.Get(ctx, "during"); err != nil {
+		t.Fatalf("value not kept in memory: %v", err)
+	}
+
+	//Until the retry interval is up, Redis isn't tried again
+	srv, err := redistest.NewServerAt(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	store.Set(ctx, "too-soon", []byte("local"), time.Minute)
+	if _, ok := srv.Get("test:too-soon"); ok {
+		t.Error("Redis retried before the retry interval")
+	}
+
+	time.Sleep(retryInterval)
+	if err := store.Set(ctx, "after", []byte("shared"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := srv.Get("test:after"); !ok {
+		t.Error("value not written to Redis once it was back")
+	}
+	if status := store.Status(); status.Down {
+		t.Errorf("Status after recovery = %+v, want up", status)
+	}
+	//A fresh Redis has none of the entries from before; they are misses
+	if _, err := store.Get(ctx, "before"); err != ErrNotFound {
+		t.Errorf("Get of an entry lost with Redis: got %v, want ErrNotFound", err)
+	}
+}
+
+func TestFallbackStoreCancelledCaller(t *testing.T) {
+	srv, redis := newTestRedis(t, "")
+	defer srv.Close()
+	defer redis.Close()
+	store := NewFallbackStore("redis", redis, NewMemoryStore())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	store.Get(ctx, "k")
+	if status := store.Status(); status.Down {
+		t.Errorf("a cancelled caller marked Redis down: %+v", status)
+	}
+}
+
+func TestFallbackStorePing(t *testing.T) {
+	srv, redis := newTestRedis(t, "")
+	defer redis.Close()
+	store := NewFallbackStore("redis", redis, NewMemoryStore())
+	ctx := context.Background()
+
+	if err := store.Ping(ctx); err != nil {
+		t.Fatalf("Ping with Redis up: %v", err)
+	}
+	if srv.Commands()["PING"] != 1 {
+		t.Errorf("commands = %v, want a PING", srv.Commands())
+	}
+
+	//An idle store learns of an outage, and of the recovery, from Ping alone
+	addr := srv.Addr()
+	srv.Close()
+	if err := store.Ping(ctx); err == nil {
+		t.Fatal("Ping with Redis down succeeded")
+	}
+	if status := store.Status(); !status.Down {
+		t.Fatalf("Status after a failed Ping = %+v, want down", status)
+	}
+	srv, err := redistest.NewServerAt(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	if err := store.Ping(ctx); err != nil {
+		t.Fatalf("Ping with Redis back: %v", err)
+	}
+	if status := store.Status(); status.Down {
+		t.Errorf("Status after a good Ping = %+v, want up before the retry interval", status)
+	}
+
+	//Stores that can't be pinged are taken as up
+	if err := NewFallbackStore("memory", NewMemoryStore(), NewMemoryStore()).Ping(ctx); err != nil {
+		t.Errorf("Ping of a store without Ping: %v", err)
+	}
+}
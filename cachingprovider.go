@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"weather-bff/cache"
+	"weather-bff/config"
+)
+
+// CachingProvider wraps a WeatherProvider with a TTL cache per data type.
+type CachingProvider struct {
+	next     WeatherProvider
+	current  *cache.Cache
+	forecast *cache.Cache
+	uv       *cache.Cache
+}
+
+// NewCachingProvider returns a CachingProvider in front of next, keeping each
+// data type in store for its TTL in ttls. For ttls.MaxStale after that, the
+// old data is served while it is refreshed in the background, each refresh
+// taking at most refreshTimeout.
+func NewCachingProvider(next WeatherProvider, ttls config.Cache, store cache.Store, refreshTimeout time.Duration) *CachingProvider {
+	options := func(ttl time.Duration) cache.Options {
+		return cache.Options{TTL: ttl, MaxStale: ttls.MaxStale, RefreshTimeout: refreshTimeout}
+	}
+	return &CachingProvider{
+		next:     next,
+		current:  cache.New(store, cache.GobCodec(CurrentWeatherData{}), options(ttls.Weather)),
+		forecast: cache.New(store, cache.GobCodec(WeatherForecast{}), options(ttls.Forecast)),
+		uv:       cache.New(store, cache.GobCodec(UVIndex{}), options(ttls.UV)),
+	}
+}
+
+// newRedisStore returns the Redis configured for sharing state between dynos,
+// or nil if there is none.
+func newRedisStore(c config.Cache) (*cache.RedisStore, error) {
+	if c.RedisURL == "" {
+		return nil, nil
+	}
+	redis, err := cache.NewRedisStore(c.RedisURL, c.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	onShutdown("redis", func(context.Context) error { return redis.Close() })
+	return redis, nil
+}
+
+// newCacheStore returns the store for cached upstream results: redis, if
+// configured, so every dyno shares one cache, or else process memory. Redis
+// is backed by process memory while it is unreachable, and the returned
+// FallbackStore reports which is in use; it is nil without Redis.
+func newCacheStore(redis *cache.RedisStore) (cache.Store, *cache.FallbackStore) {
+	local := cache.NewMemoryStore()
+	if redis == nil {
+		return local, nil
+	}
+	shared := cache.NewFallbackStore("redis", redis, local)
+	return shared, shared
+}
+
+// Name implements WeatherProvider.
+func (p *CachingProvider) Name() string {
+	return p.next.Name()
+}
+
+// CurrentWeather implements WeatherProvider.
+func (p *CachingProvider) CurrentWeather(ctx context.Context, loc Location, opts RequestOptions) (CurrentWeatherData, error) {
+	res, err := p.current.Fetch(ctx, p.weatherKey(loc, opts), func(ctx context.Context) (interface{}, error) {
+		return p.next.CurrentWeather(ctx, loc, opts)
+	})
+	if err != nil {
+		return CurrentWeatherData{}, err
+	}
+	noteFreshness(ctx, res)
+	return res.Value.(CurrentWeatherData), nil
+}
+
+// Forecast implements WeatherProvider.
+func (p *CachingProvider) Forecast(ctx context.Context, loc Location, opts RequestOptions) (WeatherForecast, error) {
+	res, err := p.forecast.Fetch(ctx, p.forecastKey(loc, opts), func(ctx context.Context) (interface{}, error) {
+		return p.next.Forecast(ctx, loc, opts)
+	})
+	if err != nil {
+		return WeatherForecast{}, err
+	}
+	noteFreshness(ctx, res)
+	return res.Value.(WeatherForecast), nil
+}
+
+// UVIndex implements WeatherProvider.
+func (p *CachingProvider) UVIndex(ctx context.Context, lat float64, long float64) (UVIndex, error) {
+	res, err := p.uv.Fetch(ctx, p.uvKey(lat, long), func(ctx context.Context) (interface{}, error) {
+		return p.next.UVIndex(ctx, lat, long)
+	})
+	if err != nil {
+		return UVIndex{}, err
+	}
+	noteFreshness(ctx, res)
+	return res.Value.(UVIndex), nil
+}
+
+// Prefetch loads the sections of a dashboard for loc that aren't cached or
+// expire within ahead, so requests for it find them fresh. It reports how
+// many upstream calls it made. The UV index needs the location's
+// coordinates, which come from the current weather unless loc has them.
+func (p *CachingProvider) Prefetch(ctx context.Context, loc Location, opts RequestOptions, sections map[string]bool, ahead time.Duration) (int, error) {
+	calls := 0
+	count := func(loaded bool) {
+		if loaded {
+			calls++
+		}
+	}
+
+	lat, long := loc.Coordinates.Latitude, loc.Coordinates.Longitude
+	if sections[sectionCurrent] || (sections[sectionUV] && loc.Kind != LocationCoordinates) {
+		res, loaded, err := p.current.Prefetch(ctx, p.weatherKey(loc, opts), ahead, func(ctx context.Context) (interface{}, error) {
+			return p.next.CurrentWeather(ctx, loc, opts)
+		})
+		count(loaded)
+		if err != nil {
+			return calls, err
+		}
+		weather := res.Value.(CurrentWeatherData)
+		lat, long = weather.GeoPos.Latitude, weather.GeoPos.Longitude
+	}
+	if sections[sectionForecast] {
+		_, loaded, err := p.forecast.Prefetch(ctx, p.forecastKey(loc, opts), ahead, func(ctx context.Context) (interface{}, error) {
+			return p.next.Forecast(ctx, loc, opts)
+		})
+		count(loaded)
+		if err != nil {
+			return calls, err
+		}
+	}
+	if sections[sectionUV] {
+		_, loaded, err := p.uv.Prefetch(ctx, p.uvKey(lat, long), ahead, func(ctx context.Context) (interface{}, error) {
+			return p.next.UVIndex(ctx, lat, long)
+		})
+		count(loaded)
+		if err != nil {
+			return calls, err
+		}
+	}
+	return calls, nil
+}
+
+func (p *CachingProvider) weatherKey(loc Location, opts RequestOptions) string {
+	return cache.Key(p.Name(), "weather", loc.Key(), opts.Units, opts.Lang)
+}
+
+func (p *CachingProvider) forecastKey(loc Location, opts RequestOptions) string {
+	return cache.Key(p.Name(), "forecast", loc.Key(), opts.Units, opts.Lang)
+}
+
+func (p *CachingProvider) uvKey(lat, long float64) string {
+	//Two decimals is roughly 1km, plenty for UV
+	return cache.Key(p.Name(), "uvi", fmt.Sprintf("%.2f,%.2f", lat, long))
+}
+
+// Stats returns the hit/miss counters of each cache.
+func (p *CachingProvider) Stats() map[string]cache.Stats {
+	return map[string]cache.Stats{
+		"weather":  p.current.Stats(),
+		"forecast": p.forecast.Stats(),
+		"uvi":      p.uv.Stats(),
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/gin-gonic/gin"
+
+	"weather-bff/config"
+)
+
+// Content codings the BFF can compress responses with, most preferred first.
+const (
+	encodingBrotli = "br"
+	encodingGzip   = "gzip"
+)
+
+// brotliQuality trades size for CPU: past 5 the encoder slows down a lot
+// for little gain on our responses, which are compressed on every request.
+const brotliQuality = 5
+
+// Compressors are pooled: each holds buffers and, for Brotli, match tables
+// worth reusing across responses.
+var (
+	gzipWriters = sync.Pool{New: func() interface{} {
+		w, _ := gzip.NewWriterLevel(ioutil.Discard, gzip.DefaultCompression)
+		return w
+	}}
+	brotliWriters = sync.Pool{New: func() interface{} {
+		return brotli.NewWriterLevel(ioutil.Discard, brotliQuality)
+	}}
+)
+
+// compressor is what gzip.Writer and brotli.Writer have in common.
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+// compressionMiddleware compresses response bodies of at least cfg.MinSize
+// bytes with the best coding the client accepts. Responses that could be
+// compressed vary by Accept-Encoding, and their ETags are made weak, since
+// the compressed and uncompressed bodies differ byte for byte but not in
+// meaning. If-None-Match compares weakly, so a client revalidates with
+// either.
+func compressionMiddleware(cfg config.Compression) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Writer.Header().Add("Vary", "Accept-Encoding")
+		encoding := negotiateEncoding(c.GetHeader("Accept-Encoding"))
+		if encoding == "" || c.Request.Method == http.MethodHead {
+			c.Next()
+			return
+		}
+
+		w := &compressWriter{ResponseWriter: c.Writer, encoding: encoding, minSize: cfg.MinSize}
+		c.Writer = w
+		defer w.close()
+		c.Next()
+	}
+}
+
+// negotiateEncoding picks the coding the client prefers by q-value out of
+// those the BFF supports, or "" for none. Ties go to Brotli, which comes out
+// smaller.
+func negotiateEncoding(header string) string {
+	best, bestQ := "", 0.0
+	wildcard := -1.0
+	q := map[string]float64{}
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+		weight := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					weight = v
+				}
+			}
+		}
+		if coding == "*" {
+			wildcard = weight
+		} else {
+			q[coding] = weight
+		}
+	}
+
+	for _, coding := range []string{encodingBrotli, encodingGzip} {
+		weight, ok := q[coding]
+		if !ok {
+			weight = wildcard
+		}
+		if weight > bestQ {
+			best, bestQ = coding, weight
+		}
+	}
+	return best
+}
+
+// compressWriter holds the body back until it reaches minSize, then decides
+// whether to compress it. Bodies that end up smaller are sent as they are.
+type compressWriter struct {
+	gin.ResponseWriter
+	encoding string
+	minSize  int
+
+	buf     []byte
+	started bool
+	cw      compressor
+}
+
+func (w *compressWriter) Write(p []byte) (int, error) {
+	if !w.started {
+		w.buf = append(w.buf, p...)
+		if len(w.buf) < w.minSize {
+			return len(p), nil
+		}
+		if err := w.start(true); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	if w.cw != nil {
+		return w.cw.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *compressWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// WriteHeaderNow sends the headers right away, as for bodyless responses
+// like 304s, so nothing is compressed.
+func (w *compressWriter) WriteHeaderNow() {
+	if !w.started {
+		w.start(false)
+	}
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *compressWriter) Flush() {
+	if !w.started {
+		w.start(len(w.buf) >= w.minSize)
+	}
+	if w.cw != nil {
+		w.cw.Flush()
+	}
+	w.ResponseWriter.Flush()
+}
+
+// start settles the headers, compressing if asked to and the response
+// allows it, and writes out what was held back.
+func (w *compressWriter) start(compress bool) error {
+	w.started = true
+	h := w.Header()
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		h.Set("ETag", "W/"+etag)
+	}
+
+	if compress && w.compressible() {
+		h.Set("Content-Encoding", w.encoding)
+		h.Del("Content-Length")
+		switch w.encoding {
+		case encodingBrotli:
+			w.cw = brotliWriters.Get().(*brotli.Writer)
+		case encodingGzip:
+			w.cw = gzipWriters.Get().(*gzip.Writer)
+		}
+		w.cw.Reset(w.ResponseWriter)
+	}
+
+	if len(w.buf) == 0 {
+		return nil
+	}
+	buf := w.buf
+	w.buf = nil
+	if w.cw != nil {
+		_, err := w.cw.Write(buf)
+		return err
+	}
+	_, err := w.ResponseWriter.Write(buf)
+	return err
+}
+
+// compressible reports whether the response is text that isn't encoded
+// already and has a body.
+func (w *compressWriter) compressible() bool {
+	status := w.Status()
+	if status < http.StatusOK || status == http.StatusNoContent || status == http.StatusNotModified {
+		return false
+	}
+	h := w.Header()
+	if h.Get("Content-Encoding") != "" {
+		return false
+	}
+	contentType := h.Get("Content-Type")
+	for _, prefix := range []string{"application/json", "text/", "application/javascript", "application/xml", "image/svg+xml"} {
+		if strings.HasPrefix(contentType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// close finishes the body once the handlers are done.
+func (w *compressWriter) close() {
+	if !w.started {
+		w.start(false)
+	}
+	if w.cw == nil {
+		return
+	}
+	w.cw.Close()
+	switch cw := w.cw.(type) {
+	case *brotli.Writer:
+		cw.Reset(ioutil.Discard)
+		brotliWriters.Put(cw)
+	case *gzip.Writer:
+		cw.Reset(ioutil.Discard)
+		gzipWriters.Put(cw)
+	}
+	w.cw = nil
+}
@@ -0,0 +1,673 @@
+// Package config loads the BFF's settings from an optional YAML file and the
+// environment, and validates them at startup.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Upstream describes how to reach one upstream API.
+type Upstream struct {
+	APIKey string `yaml:"api_key"`
+	// APIKeys is a pool of keys to rotate through, used along with APIKey.
+	APIKeys []string `yaml:"api_keys"`
+	BaseURL string   `yaml:"base_url"`
+}
+
+// Keys returns every configured key, APIKey first, without duplicates.
+func (u Upstream) Keys() []string {
+	var keys []string
+	seen := make(map[string]bool)
+	for _, k := range append([]string{u.APIKey}, u.APIKeys...) {
+		if k != "" && !seen[k] {
+			keys = append(keys, k)
+			seen[k] = true
+		}
+	}
+	return keys
+}
+
+// Compression compresses responses for clients that accept gzip or Brotli.
+type Compression struct {
+	Enabled bool `yaml:"enabled"`
+	// MinSize is the smallest body, in bytes, worth compressing.
+	MinSize int `yaml:"min_size"`
+}
+
+// Prefetch keeps the most requested locations warm in the cache.
+type Prefetch struct {
+	Enabled bool `yaml:"enabled"`
+	// Locations is how many of the most requested locations are kept warm.
+	Locations int `yaml:"locations"`
+	// Interval is how often entries about to expire are refreshed.
+	Interval time.Duration `yaml:"interval"`
+}
+
+// Quota is the OpenWeatherMap plan's cap on calls per API key. Every attempt
+// at a call, retries included, counts.
+type Quota struct {
+	// PerMinute and PerDay are the caps; zero means none.
+	PerMinute int `yaml:"per_minute"`
+	PerDay    int `yaml:"per_day"`
+	// Reserve is the fraction of each cap left unused as headroom. Calls
+	// beyond the rest are shed, or answered from stale cache entries.
+	Reserve float64 `yaml:"reserve"`
+}
+
+// Timeouts bound how long the BFF waits on upstreams.
+type Timeouts struct {
+	// Upstream is the timeout for a single attempt at an outbound HTTP call.
+	Upstream time.Duration `yaml:"upstream"`
+	// Dashboard is the deadline for the whole /dashboard fan-out.
+	Dashboard time.Duration `yaml:"dashboard"`
+	// Shutdown is the grace period in-flight requests get to finish after
+	// SIGTERM before their connections are closed.
+	Shutdown time.Duration `yaml:"shutdown"`
+}
+
+// Cache configures where upstream results are cached, and for how long per
+// data type.
+type Cache struct {
+	// RedisURL, if set, points at a Redis shared by all dynos, e.g.
+	// redis://:password@host:6379/0, which also counts quota spend. Results
+	// are cached, and spend counted, in process otherwise, and while Redis is
+	// unreachable.
+	RedisURL string `yaml:"redis_url"`
+	// Namespace prefixes every key in Redis, so several apps or versions can
+	// share one.
+	Namespace string `yaml:"namespace"`
+
+	Weather  time.Duration `yaml:"weather"`
+	Forecast time.Duration `yaml:"forecast"`
+	UV       time.Duration `yaml:"uv"`
+	// MaxStale is how long past their TTL entries are still served, marked
+	// stale, while they are refreshed in the background. It also bounds how
+	// old data gets while OpenWeatherMap is down or the quota is exhausted.
+	MaxStale time.Duration `yaml:"max_stale"`
+}
+
+// Resilience tunes retries and circuit breaking of upstream calls.
+type Resilience struct {
+	// MaxAttempts is the most times a call is tried, including the first.
+	MaxAttempts    int           `yaml:"max_attempts"`
+	RetryBaseDelay time.Duration `yaml:"retry_base_delay"`
+	RetryMaxDelay  time.Duration `yaml:"retry_max_delay"`
+	// BreakerThreshold consecutive failures open an upstream's breaker for
+	// BreakerOpenTimeout.
+	BreakerThreshold   int           `yaml:"breaker_threshold"`
+	BreakerOpenTimeout time.Duration `yaml:"breaker_open_timeout"`
+}
+
+// Limit allows Requests per Per on average, with bursts of up to Burst.
+// Zero Requests means no limit.
+type Limit struct {
+	Requests int           `yaml:"requests"`
+	Per      time.Duration `yaml:"per"`
+	Burst    int           `yaml:"burst"`
+}
+
+// RateLimit configures per-client rate limiting.
+type RateLimit struct {
+	Enabled bool `yaml:"enabled"`
+	// Default applies to routes not listed in Routes.
+	Default Limit `yaml:"default"`
+	// Routes overrides the limit by route path.
+	Routes map[string]Limit `yaml:"routes"`
+	// AuthFailures limits failed authentication attempts per IP address,
+	// checked before a request is authenticated.
+	AuthFailures Limit `yaml:"auth_failures"`
+}
+
+// ClientKey is an API key issued to one client build.
+type ClientKey struct {
+	// Label names the client in logs and metrics, e.g. "android-2.3".
+	Label string `yaml:"label"`
+	Key   string `yaml:"key"`
+	// Secret, if set, is the HMAC secret the client must sign requests with.
+	Secret string `yaml:"secret"`
+	// Scopes lists what the key may access: weather, fact, ops, or * for
+	// everything.
+	Scopes []string `yaml:"scopes"`
+	// Disabled revokes the key.
+	Disabled bool `yaml:"disabled"`
+}
+
+// Auth configures client authentication.
+type Auth struct {
+	// Enabled requires an API key on every route but the index and health
+	// checks.
+	Enabled bool        `yaml:"enabled"`
+	Keys    []ClientKey `yaml:"keys"`
+	// MaxSkew is how far a signed request's timestamp may be from now.
+	MaxSkew time.Duration `yaml:"max_skew"`
+}
+
+// Tracing selects where spans are exported.
+type Tracing struct {
+	// Exporter is "none", "stdout" or "otlp".
+	Exporter string `yaml:"exporter"`
+	// Endpoint is the OTLP/HTTP collector's base URL, e.g.
+	// http://localhost:4318. Only used by the otlp exporter.
+	Endpoint    string `yaml:"endpoint"`
+	ServiceName string `yaml:"service_name"`
+}
+
+// Logging configures the structured logger.
+type Logging struct {
+	// Level is the least severe level written: debug, info, warn or error.
+	Level string `yaml:"level"`
+}
+
+// Config is the complete BFF configuration.
+type Config struct {
+	Port    string `yaml:"port"`
+	Units   string `yaml:"units"`
+	Country string `yaml:"country"`
+	// TrustedProxies is how many proxies in front of the BFF append the
+	// address they were connected from to X-Forwarded-For, e.g. 1 for
+	// Heroku's router. With none, the client is whoever connected.
+	TrustedProxies int `yaml:"trusted_proxies"`
+	// DebugRoutes serves /debug/* with authentication off. With it on, they
+	// are always served, to keys with the ops scope.
+	DebugRoutes bool `yaml:"debug_routes"`
+
+	OpenWeatherMap Upstream `yaml:"openweathermap"`
+	Fact           Upstream `yaml:"fact"`
+
+	Timeouts   Timeouts   `yaml:"timeouts"`
+	Resilience Resilience `yaml:"resilience"`
+	Cache      Cache      `yaml:"cache"`
+	Tracing    Tracing    `yaml:"tracing"`
+	Logging    Logging    `yaml:"logging"`
+	RateLimit  RateLimit  `yaml:"rate_limit"`
+	Auth       Auth       `yaml:"auth"`
+	Quota      Quota      `yaml:"quota"`
+	Prefetch   Prefetch   `yaml:"prefetch"`
+
+	Compression Compression `yaml:"compression"`
+}
+
+// Units accepted by the weather providers.
+var validUnits = map[string]bool{
+	"imperial": true,
+	"metric":   true,
+	"standard": true,
+}
+
+// Log levels.
+var validLogLevels = map[string]bool{
+	"debug": true,
+	"info":  true,
+	"warn":  true,
+	"error": true,
+}
+
+// Scopes API keys can be granted.
+var validScopes = map[string]bool{
+	"weather": true,
+	"fact":    true,
+	"ops":     true,
+	"*":       true,
+}
+
+// Trace exporters.
+var validExporters = map[string]bool{
+	"none":   true,
+	"stdout": true,
+	"otlp":   true,
+}
+
+// Default returns the configuration used for anything not set explicitly.
+// It deliberately has no API keys.
+func Default() Config {
+	return Config{
+		Units:   "imperial",
+		Country: "US",
+		OpenWeatherMap: Upstream{
+			BaseURL: "http://api.openweathermap.org/data/2.5",
+		},
+		Fact: Upstream{
+			BaseURL: "https://api.chucknorris.io",
+		},
+		Timeouts: Timeouts{
+			Upstream:  5 * time.Second,
+			Dashboard: 8 * time.Second,
+			Shutdown:  20 * time.Second,
+		},
+		Resilience: Resilience{
+			MaxAttempts:        3,
+			RetryBaseDelay:     200 * time.Millisecond,
+			RetryMaxDelay:      2 * time.Second,
+			BreakerThreshold:   5,
+			BreakerOpenTimeout: 30 * time.Second,
+		},
+		Cache: Cache{
+			Namespace: "weather-bff",
+			Weather:   10 * time.Minute,
+			Forecast:  30 * time.Minute,
+			UV:        time.Hour,
+			MaxStale:  time.Hour,
+		},
+		//The free plan's cap. It has no daily cap, but a monthly one of
+		//about 33k calls a day.
+		Quota: Quota{
+			PerMinute: 60,
+			Reserve:   0.1,
+		},
+		Prefetch: Prefetch{
+			Enabled:   true,
+			Locations: 100,
+			Interval:  time.Minute,
+		},
+		//Below about a packet, compressing saves no round trips
+		Compression: Compression{
+			Enabled: true,
+			MinSize: 1024,
+		},
+		Tracing: Tracing{
+			Exporter:    "none",
+			ServiceName: "weather-bff",
+		},
+		Logging: Logging{
+			Level: "info",
+		},
+		RateLimit: RateLimit{
+			Enabled: true,
+			Default: Limit{Requests: 60, Per: time.Minute, Burst: 20},
+			Routes: map[string]Limit{
+				//Each dashboard costs up to four upstream calls
+				"/dashboard":    {Requests: 30, Per: time.Minute, Burst: 10},
+				"/v2/dashboard": {Requests: 30, Per: time.Minute, Burst: 10},
+				//Monitoring must never be throttled
+				"/healthz": {},
+				"/readyz":  {},
+				"/metrics": {},
+			},
+			AuthFailures: Limit{Requests: 10, Per: time.Minute, Burst: 10},
+		},
+		Auth: Auth{
+			MaxSkew: 5 * time.Minute,
+		},
+	}
+}
+
+// Load starts from Default, applies the YAML file named by $CONFIG_FILE if
+// set, then environment variables, and validates the result.
+func Load() (*Config, error) {
+	cfg := Default()
+
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		if err := cfg.LoadFile(path); err != nil {
+			return nil, err
+		}
+	}
+	if err := cfg.ApplyEnv(os.Getenv); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// LoadFile overlays the settings in the YAML file at path onto c.
+func (c *Config) LoadFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config: %v", err)
+	}
+	//Strict decoding rejects map keys that are already set, so decode routes
+	//into an empty map and keep the defaults the file doesn't override
+	routes := c.RateLimit.Routes
+	c.RateLimit.Routes = nil
+	if err := yaml.UnmarshalStrict(data, c); err != nil {
+		c.RateLimit.Routes = routes
+		return fmt.Errorf("config: %s: %v", path, err)
+	}
+	for route, limit := range routes {
+		if _, ok := c.RateLimit.Routes[route]; !ok {
+			if c.RateLimit.Routes == nil {
+				c.RateLimit.Routes = make(map[string]Limit)
+			}
+			c.RateLimit.Routes[route] = limit
+		}
+	}
+	return nil
+}
+
+// ApplyEnv overlays any settings present in the environment onto c.
+func (c *Config) ApplyEnv(getenv func(string) string) error {
+	strs := []struct {
+		name string
+		dst  *string
+	}{
+		{"PORT", &c.Port},
+		{"DEFAULT_UNITS", &c.Units},
+		{"DEFAULT_COUNTRY", &c.Country},
+		{"OPENWEATHERMAP_API_KEY", &c.OpenWeatherMap.APIKey},
+		{"OPENWEATHERMAP_BASE_URL", &c.OpenWeatherMap.BaseURL},
+		{"FACT_API_KEY", &c.Fact.APIKey},
+		{"FACT_BASE_URL", &c.Fact.BaseURL},
+		{"TRACE_EXPORTER", &c.Tracing.Exporter},
+		{"OTEL_EXPORTER_OTLP_ENDPOINT", &c.Tracing.Endpoint},
+		{"OTEL_SERVICE_NAME", &c.Tracing.ServiceName},
+		{"LOG_LEVEL", &c.Logging.Level},
+		{"REDIS_URL", &c.Cache.RedisURL},
+		{"CACHE_NAMESPACE", &c.Cache.Namespace},
+	}
+	for _, s := range strs {
+		if v := getenv(s.name); v != "" {
+			*s.dst = v
+		}
+	}
+
+	durations := []struct {
+		name string
+		dst  *time.Duration
+	}{
+		{"UPSTREAM_TIMEOUT", &c.Timeouts.Upstream},
+		{"DASHBOARD_TIMEOUT", &c.Timeouts.Dashboard},
+		{"SHUTDOWN_TIMEOUT", &c.Timeouts.Shutdown},
+		{"CACHE_WEATHER_TTL", &c.Cache.Weather},
+		{"CACHE_FORECAST_TTL", &c.Cache.Forecast},
+		{"CACHE_UV_TTL", &c.Cache.UV},
+		{"CACHE_MAX_STALE", &c.Cache.MaxStale},
+		{"PREFETCH_INTERVAL", &c.Prefetch.Interval},
+		{"UPSTREAM_RETRY_BASE_DELAY", &c.Resilience.RetryBaseDelay},
+		{"UPSTREAM_RETRY_MAX_DELAY", &c.Resilience.RetryMaxDelay},
+		{"BREAKER_OPEN_TIMEOUT", &c.Resilience.BreakerOpenTimeout},
+		{"RATE_LIMIT_PER", &c.RateLimit.Default.Per},
+		{"AUTH_MAX_SKEW", &c.Auth.MaxSkew},
+	}
+	for _, d := range durations {
+		v := getenv(d.name)
+		if v == "" {
+			continue
+		}
+		parsed, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("config: $%s: %v", d.name, err)
+		}
+		*d.dst = parsed
+	}
+
+	ints := []struct {
+		name string
+		dst  *int
+	}{
+		{"UPSTREAM_MAX_ATTEMPTS", &c.Resilience.MaxAttempts},
+		{"BREAKER_THRESHOLD", &c.Resilience.BreakerThreshold},
+		{"RATE_LIMIT_REQUESTS", &c.RateLimit.Default.Requests},
+		{"RATE_LIMIT_BURST", &c.RateLimit.Default.Burst},
+		{"QUOTA_PER_MINUTE", &c.Quota.PerMinute},
+		{"QUOTA_PER_DAY", &c.Quota.PerDay},
+		{"PREFETCH_LOCATIONS", &c.Prefetch.Locations},
+		{"COMPRESSION_MIN_SIZE", &c.Compression.MinSize},
+		{"TRUSTED_PROXIES", &c.TrustedProxies},
+	}
+	for _, i := range ints {
+		v := getenv(i.name)
+		if v == "" {
+			continue
+		}
+		parsed, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("config: $%s: %v", i.name, err)
+		}
+		*i.dst = parsed
+	}
+
+	if v := getenv("QUOTA_RESERVE"); v != "" {
+		parsed, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return fmt.Errorf("config: $QUOTA_RESERVE: %v", err)
+		}
+		c.Quota.Reserve = parsed
+	}
+	if v := getenv("OPENWEATHERMAP_API_KEYS"); v != "" {
+		c.OpenWeatherMap.APIKeys = nil
+		for _, k := range strings.Split(v, ",") {
+			if k = strings.TrimSpace(k); k != "" {
+				c.OpenWeatherMap.APIKeys = append(c.OpenWeatherMap.APIKeys, k)
+			}
+		}
+	}
+
+	bools := []struct {
+		name string
+		dst  *bool
+	}{
+		{"DEBUG_ROUTES", &c.DebugRoutes},
+		{"RATE_LIMIT_ENABLED", &c.RateLimit.Enabled},
+		{"AUTH_ENABLED", &c.Auth.Enabled},
+		{"PREFETCH_ENABLED", &c.Prefetch.Enabled},
+		{"COMPRESSION_ENABLED", &c.Compression.Enabled},
+	}
+	for _, b := range bools {
+		v := getenv(b.name)
+		if v == "" {
+			continue
+		}
+		parsed, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("config: $%s: %v", b.name, err)
+		}
+		*b.dst = parsed
+	}
+
+	//Keys can be changed with a config var, which restarts the dynos
+	//without a redeploy. JSON is valid YAML.
+	if v := getenv("AUTH_KEYS"); v != "" {
+		var keys []ClientKey
+		if err := yaml.UnmarshalStrict([]byte(v), &keys); err != nil {
+			return fmt.Errorf("config: $AUTH_KEYS: %v", err)
+		}
+		c.Auth.Keys = keys
+	}
+	return nil
+}
+
+// Validate reports every problem with c at once, so a bad deploy can be fixed
+// in one go.
+func (c *Config) Validate() error {
+	var problems []string
+
+	if port, err := strconv.Atoi(c.Port); err != nil || port < 1 || port > 65535 {
+		problems = append(problems, fmt.Sprintf("port %q must be a number between 1 and 65535", c.Port))
+	}
+	if !validUnits[c.Units] {
+		problems = append(problems, fmt.Sprintf("units %q must be one of imperial, metric, standard", c.Units))
+	}
+	if len(c.Country) != 2 {
+		problems = append(problems, fmt.Sprintf("country %q must be an ISO 3166 alpha-2 code", c.Country))
+	}
+	if len(c.OpenWeatherMap.Keys()) == 0 {
+		problems = append(problems, "openweathermap api_key or api_keys is required")
+	}
+	if err := validateBaseURL(c.OpenWeatherMap.BaseURL); err != nil {
+		problems = append(problems, fmt.Sprintf("openweathermap base_url: %v", err))
+	}
+	if err := validateBaseURL(c.Fact.BaseURL); err != nil {
+		problems = append(problems, fmt.Sprintf("fact base_url: %v", err))
+	}
+
+	if !validLogLevels[c.Logging.Level] {
+		problems = append(problems, fmt.Sprintf("logging.level %q must be one of debug, info, warn, error", c.Logging.Level))
+	}
+	if !validExporters[c.Tracing.Exporter] {
+		problems = append(problems, fmt.Sprintf("tracing.exporter %q must be one of none, stdout, otlp", c.Tracing.Exporter))
+	}
+	if c.Tracing.Exporter == "otlp" {
+		if err := validateBaseURL(c.Tracing.Endpoint); err != nil {
+			problems = append(problems, fmt.Sprintf("tracing.endpoint: %v", err))
+		}
+	}
+
+	durations := []struct {
+		name string
+		d    time.Duration
+	}{
+		{"timeouts.upstream", c.Timeouts.Upstream},
+		{"timeouts.dashboard", c.Timeouts.Dashboard},
+		{"timeouts.shutdown", c.Timeouts.Shutdown},
+		{"cache.weather", c.Cache.Weather},
+		{"cache.forecast", c.Cache.Forecast},
+		{"cache.uv", c.Cache.UV},
+		{"resilience.retry_base_delay", c.Resilience.RetryBaseDelay},
+		{"resilience.retry_max_delay", c.Resilience.RetryMaxDelay},
+		{"resilience.breaker_open_timeout", c.Resilience.BreakerOpenTimeout},
+		{"prefetch.interval", c.Prefetch.Interval},
+	}
+	for _, d := range durations {
+		if d.d <= 0 {
+			problems = append(problems, fmt.Sprintf("%s must be positive", d.name))
+		}
+	}
+	if c.Cache.RedisURL != "" {
+		if err := validateRedisURL(c.Cache.RedisURL); err != nil {
+			problems = append(problems, fmt.Sprintf("cache.redis_url: %v", err))
+		}
+	}
+	if c.Cache.Namespace == "" {
+		problems = append(problems, "cache.namespace is required")
+	}
+	if c.Cache.MaxStale < 0 {
+		problems = append(problems, "cache.max_stale must not be negative")
+	}
+	if c.Prefetch.Locations < 0 {
+		problems = append(problems, "prefetch.locations must not be negative")
+	}
+	if c.TrustedProxies < 0 {
+		problems = append(problems, "trusted_proxies must not be negative")
+	}
+	if c.Compression.MinSize < 0 {
+		problems = append(problems, "compression.min_size must not be negative")
+	}
+	if c.Quota.PerMinute < 0 || c.Quota.PerDay < 0 {
+		problems = append(problems, "quota.per_minute and quota.per_day must not be negative")
+	}
+	if c.Quota.Reserve < 0 || c.Quota.Reserve >= 1 {
+		problems = append(problems, "quota.reserve must be at least 0 and less than 1")
+	}
+	if c.Resilience.MaxAttempts < 1 {
+		problems = append(problems, "resilience.max_attempts must be at least 1")
+	}
+	if c.Resilience.BreakerThreshold < 1 {
+		problems = append(problems, "resilience.breaker_threshold must be at least 1")
+	}
+
+	problems = append(problems, validateLimit("rate_limit.default", c.RateLimit.Default)...)
+	problems = append(problems, validateLimit("rate_limit.auth_failures", c.RateLimit.AuthFailures)...)
+	routes := make([]string, 0, len(c.RateLimit.Routes))
+	for route := range c.RateLimit.Routes {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+	for _, route := range routes {
+		if !strings.HasPrefix(route, "/") {
+			problems = append(problems, fmt.Sprintf("rate_limit.routes: %q must be a path starting with /", route))
+		}
+		problems = append(problems, validateLimit("rate_limit.routes."+route, c.RateLimit.Routes[route])...)
+	}
+
+	problems = append(problems, c.Auth.validate()...)
+
+	if len(problems) > 0 {
+		return fmt.Errorf("config: invalid configuration:\n  %s", strings.Join(problems, "\n  "))
+	}
+
+	c.Country = strings.ToUpper(c.Country)
+	c.OpenWeatherMap.BaseURL = strings.TrimRight(c.OpenWeatherMap.BaseURL, "/")
+	c.Fact.BaseURL = strings.TrimRight(c.Fact.BaseURL, "/")
+	c.Tracing.Endpoint = strings.TrimRight(c.Tracing.Endpoint, "/")
+	return nil
+}
+
+func (a *Auth) validate() []string {
+	var problems []string
+	if a.MaxSkew <= 0 {
+		problems = append(problems, "auth.max_skew must be positive")
+	}
+	if a.Enabled && len(a.Keys) == 0 {
+		problems = append(problems, "auth is enabled but no keys are configured")
+	}
+
+	labels := make(map[string]bool)
+	keys := make(map[string]bool)
+	for i, k := range a.Keys {
+		name := fmt.Sprintf("auth.keys[%d]", i)
+		if k.Label == "" {
+			problems = append(problems, name+": label is required")
+		} else if labels[k.Label] {
+			problems = append(problems, fmt.Sprintf("%s: label %q is used twice", name, k.Label))
+		}
+		labels[k.Label] = true
+
+		if len(k.Key) < 16 {
+			problems = append(problems, fmt.Sprintf("%s (%s): key must be at least 16 characters", name, k.Label))
+		} else if keys[k.Key] {
+			problems = append(problems, fmt.Sprintf("%s (%s): key is used twice", name, k.Label))
+		}
+		keys[k.Key] = true
+
+		if len(k.Scopes) == 0 {
+			problems = append(problems, fmt.Sprintf("%s (%s): at least one scope is required", name, k.Label))
+		}
+		for _, scope := range k.Scopes {
+			if !validScopes[scope] {
+				problems = append(problems, fmt.Sprintf("%s (%s): scope %q must be one of weather, fact, ops, *", name, k.Label, scope))
+			}
+		}
+	}
+	return problems
+}
+
+func validateLimit(name string, l Limit) []string {
+	var problems []string
+	if l.Requests < 0 || l.Burst < 0 {
+		problems = append(problems, fmt.Sprintf("%s: requests and burst must not be negative", name))
+	}
+	if l.Requests > 0 && l.Per <= 0 {
+		problems = append(problems, fmt.Sprintf("%s: per must be positive", name))
+	}
+	return problems
+}
+
+func validateRedisURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		//The error would include the password
+		return errors.New("not a valid URL")
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return fmt.Errorf("scheme %q must be redis or rediss", u.Scheme)
+	}
+	if u.Host == "" {
+		return errors.New("URL has no host")
+	}
+	return nil
+}
+
+func validateBaseURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%q must be an http or https URL", raw)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("%q has no host", raw)
+	}
+	return nil
+}
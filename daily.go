@@ -0,0 +1,141 @@
+package main
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DailySummary aggregates the forecast entries falling on one calendar day in
+// the location's own timezone.
+type DailySummary struct {
+	// Date is the local date, YYYY-MM-DD.
+	Date    string  `json:"date"`
+	TempMin float64 `json:"tempMin"`
+	TempMax float64 `json:"tempMax"`
+	// Weather is the dominant condition of the day.
+	Weather     Weather   `json:"weather"`
+	Condition   Condition `json:"condition"`
+	HumidityMax int       `json:"humidityMax"`
+	// Precipitation is the day's total rain and snow in mm, and
+	// PrecipitationChance the highest probability of it from 0 to 1.
+	Precipitation       float64 `json:"precipitation"`
+	PrecipitationChance float64 `json:"precipitationChance"`
+}
+
+// DailyResponse is the /daily response.
+type DailyResponse struct {
+	Daily []DailySummary `json:"daily"`
+	// TimezoneOffset is the location's offset from UTC in seconds, which the
+	// days are computed in.
+	TimezoneOffset int        `json:"timezoneOffset"`
+	Units          UnitSystem `json:"units"`
+	Lang           string     `json:"lang,omitempty"`
+	Freshness
+}
+
+// conditionSeverity breaks ties between equally frequent conditions in favour
+// of the one that matters more to someone planning their day.
+var conditionSeverity = map[Condition]int{
+	ConditionUnknown:      0,
+	ConditionClear:        1,
+	ConditionPartlyCloudy: 2,
+	ConditionCloudy:       3,
+	ConditionFog:          4,
+	ConditionDrizzle:      5,
+	ConditionRain:         6,
+	ConditionSnow:         7,
+	ConditionThunderstorm: 8,
+}
+
+// aggregateDaily groups the forecast's entries by local day. The dominant
+// condition is the one reported by the most entries that day.
+func aggregateDaily(f WeatherForecast) []DailySummary {
+	zone := time.FixedZone("", f.TimezoneOffset)
+
+	days := []DailySummary{}
+	var counts map[Condition]int
+
+	for _, entry := range f.List {
+		date := time.Unix(int64(entry.Dt), 0).In(zone).Format("2006-01-02")
+
+		if len(days) == 0 || days[len(days)-1].Date != date {
+			days = append(days, DailySummary{
+				Date:      date,
+				TempMin:   entry.Main.TempMin,
+				TempMax:   entry.Main.TempMax,
+				Condition: ConditionUnknown,
+			})
+			counts = make(map[Condition]int)
+		}
+		day := &days[len(days)-1]
+
+		if entry.Main.TempMin < day.TempMin {
+			day.TempMin = entry.Main.TempMin
+		}
+		if entry.Main.TempMax > day.TempMax {
+			day.TempMax = entry.Main.TempMax
+		}
+		if entry.Main.Humidity > day.HumidityMax {
+			day.HumidityMax = entry.Main.Humidity
+		}
+		if entry.PrecipitationChance > day.PrecipitationChance {
+			day.PrecipitationChance = entry.PrecipitationChance
+		}
+		day.Precipitation += entry.Precipitation
+
+		if len(entry.Weather) == 0 {
+			continue
+		}
+		w := entry.Weather[0]
+		counts[w.Condition]++
+		if dominates(w.Condition, day.Condition, counts) {
+			day.Condition = w.Condition
+			day.Weather = w
+		}
+	}
+
+	for i := range days {
+		days[i].Precipitation = roundTo(days[i].Precipitation, 1)
+	}
+	return days
+}
+
+func dominates(candidate, current Condition, counts map[Condition]int) bool {
+	if counts[candidate] != counts[current] {
+		return counts[candidate] > counts[current]
+	}
+	return conditionSeverity[candidate] > conditionSeverity[current]
+}
+
+func dailyHandler(c *gin.Context) {
+	loc, opts, ok := parseDashboardRequest(c)
+	if !ok {
+		return
+	}
+
+	recordSections(loc, opts, sectionForecast)
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+
+	ch := make(chan forecastResult, 1)
+	go GetForecast(ctx, weatherProvider, ch, loc, opts)
+
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			respondSectionError(c, sectionDaily, newSectionError(r.err))
+			return
+		}
+		respondCached(c, DailyResponse{
+			Daily:          aggregateDaily(r.data),
+			TimezoneOffset: r.data.TimezoneOffset,
+			Units:          unitSystems[opts.Units],
+			Lang:           opts.Lang,
+			Freshness:      freshnessFrom(ctx).report(),
+		}, cacheable)
+	case <-ctx.Done():
+		respondSectionError(c, sectionDaily, timeoutSectionError)
+	}
+}
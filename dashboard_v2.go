@@ -0,0 +1,160 @@
+package main
+
+import (
+	"math"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DashboardV2 is the /v2/dashboard response. Unlike DashboardResponse it is
+// designed around what the app renders rather than mirroring upstream
+// payloads. Sections that could not be fetched are omitted and described in
+// Errors, keyed by section name.
+type DashboardV2 struct {
+	Location *PlaceV2                `json:"location,omitempty"`
+	Current  *CurrentV2              `json:"current,omitempty"`
+	Forecast []ForecastDayV2         `json:"forecast,omitempty"`
+	UV       *UVV2                   `json:"uv,omitempty"`
+	Fact     string                  `json:"fact,omitempty"`
+	Units    UnitSystem              `json:"units"`
+	Lang     string                  `json:"lang,omitempty"`
+	Errors   map[string]SectionError `json:"errors,omitempty"`
+	Freshness
+}
+
+// PlaceV2 is the place the upstream resolved the requested location to.
+type PlaceV2 struct {
+	Name      string  `json:"name"`
+	Latitude  float64 `json:"lat"`
+	Longitude float64 `json:"lon"`
+}
+
+// CurrentV2 is the current conditions. Temperatures are rounded to whole
+// degrees; timestamps are RFC 3339 in UTC.
+type CurrentV2 struct {
+	ObservedAt  string    `json:"observedAt"`
+	Temperature int       `json:"temperature"`
+	High        int       `json:"high"`
+	Low         int       `json:"low"`
+	Humidity    int       `json:"humidity"`
+	Pressure    int       `json:"pressure"`
+	Condition   Condition `json:"condition"`
+	Description string    `json:"description"`
+	IconURL     string    `json:"iconUrl,omitempty"`
+}
+
+// ForecastDayV2 summarizes one day of the forecast, in the location's local
+// time. Precipitation is in mm.
+type ForecastDayV2 struct {
+	Date                string    `json:"date"`
+	High                int       `json:"high"`
+	Low                 int       `json:"low"`
+	Condition           Condition `json:"condition"`
+	Description         string    `json:"description"`
+	IconURL             string    `json:"iconUrl,omitempty"`
+	HumidityMax         int       `json:"humidityMax"`
+	Precipitation       float64   `json:"precipitation"`
+	PrecipitationChance float64   `json:"precipitationChance"`
+}
+
+// UVV2 is the UV index with its display level and color.
+type UVV2 struct {
+	Index float64 `json:"index"`
+	Level string  `json:"level"`
+	Color string  `json:"color"`
+}
+
+func dashboardV2Handler(c *gin.Context) {
+	loc, opts, ok := parseDashboardRequest(c)
+	if !ok {
+		return
+	}
+	sections, ok := parseSectionsRequest(c, dashboardSections)
+	if !ok {
+		return
+	}
+
+	popularLocations.record(loc, opts, sections)
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	data := fetchDashboard(ctx, loc, opts, sections)
+
+	resp := DashboardV2{Units: unitSystems[opts.Units], Lang: opts.Lang, Freshness: freshnessFrom(ctx).report()}
+	if data.weather != nil {
+		resp.Location = &PlaceV2{
+			Name:      data.weather.Name,
+			Latitude:  data.weather.GeoPos.Latitude,
+			Longitude: data.weather.GeoPos.Longitude,
+		}
+		resp.Current = newCurrentV2(*data.weather)
+	}
+	if data.forecast != nil {
+		resp.Forecast = newForecastV2(*data.forecast)
+	}
+	if data.uv != nil {
+		resp.UV = &UVV2{
+			Index: roundTo(data.uv.Value, 1),
+			Level: data.uv.StringValue,
+			Color: data.uv.ColorValue,
+		}
+	}
+	if data.fact != nil {
+		resp.Fact = data.fact.Value
+	}
+	if len(data.errors) > 0 {
+		resp.Errors = data.errors
+	}
+
+	withoutFact := resp
+	withoutFact.Fact = ""
+	data.respond(c, resp, withoutFact)
+}
+
+func newCurrentV2(w CurrentWeatherData) *CurrentV2 {
+	current := &CurrentV2{
+		ObservedAt:  formatUnix(w.Dt),
+		Temperature: roundTemp(w.Main.Temp),
+		High:        roundTemp(w.Main.TempMax),
+		Low:         roundTemp(w.Main.TempMin),
+		Humidity:    w.Main.Humidity,
+		Pressure:    int(math.Round(w.Main.Pressure)),
+		Condition:   ConditionUnknown,
+	}
+	if len(w.Weather) > 0 {
+		current.Condition = w.Weather[0].Condition
+		current.Description = w.Weather[0].Description
+		current.IconURL = w.Weather[0].IconURL
+	}
+	return current
+}
+
+// newForecastV2 is the daily aggregation of f with rounded temperatures.
+func newForecastV2(f WeatherForecast) []ForecastDayV2 {
+	daily := aggregateDaily(f)
+
+	days := make([]ForecastDayV2, 0, len(daily))
+	for _, d := range daily {
+		days = append(days, ForecastDayV2{
+			Date:                d.Date,
+			High:                roundTemp(d.TempMax),
+			Low:                 roundTemp(d.TempMin),
+			Condition:           d.Condition,
+			Description:         d.Weather.Description,
+			IconURL:             d.Weather.IconURL,
+			HumidityMax:         d.HumidityMax,
+			Precipitation:       d.Precipitation,
+			PrecipitationChance: d.PrecipitationChance,
+		})
+	}
+	return days
+}
+
+func roundTemp(t float64) int {
+	return int(math.Round(t))
+}
+
+func formatUnix(sec int) string {
+	return time.Unix(int64(sec), 0).UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"weather-bff/cache"
+)
+
+// freshness tracks how old the cached data behind a response is, so the app
+// can show when it was last updated. requestContext puts one in every
+// request's context and CachingProvider notes each result it returns. The
+// handlers note when the sections they respond with were observed.
+type freshness struct {
+	mu      sync.Mutex
+	asOf    time.Time
+	expires time.Time
+	stale   bool
+	// observed is the newest observation time of the sections in the
+	// response, and unobserved is set if any of them has none.
+	observed   time.Time
+	unobserved bool
+}
+
+type freshnessKey struct{}
+
+func withFreshness(ctx context.Context) context.Context {
+	return context.WithValue(ctx, freshnessKey{}, &freshness{})
+}
+
+// freshnessFrom returns the freshness in ctx, or nil if there is none.
+func freshnessFrom(ctx context.Context) *freshness {
+	f, _ := ctx.Value(freshnessKey{}).(*freshness)
+	return f
+}
+
+// noteFreshness records a cached result, if ctx tracks freshness.
+func noteFreshness(ctx context.Context, res cache.Result) {
+	f := freshnessFrom(ctx)
+	if f == nil {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.asOf.IsZero() || res.AsOf.Before(f.asOf) {
+		f.asOf = res.AsOf
+	}
+	if f.expires.IsZero() || res.Expires.Before(f.expires) {
+		f.expires = res.Expires
+	}
+	f.stale = f.stale || res.Stale
+}
+
+// noteObserved records the observation time, in Unix seconds, of a section
+// of the response, or 0 for a section without one, like a forecast.
+func noteObserved(ctx context.Context, dt int) {
+	f := freshnessFrom(ctx)
+	if f == nil {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if dt == 0 {
+		f.unobserved = true
+		return
+	}
+	if at := time.Unix(int64(dt), 0); at.After(f.observed) {
+		f.observed = at
+	}
+}
+
+// Freshness is embedded in responses built from cached weather data. AsOf is
+// when the oldest of it was fetched from the upstream, in RFC 3339; Stale is
+// set if any of it is past its TTL and being refreshed.
+type Freshness struct {
+	AsOf  string `json:"asOf,omitempty"`
+	Stale bool   `json:"stale,omitempty"`
+}
+
+// report returns what f noted so far. It is safe to call on a nil f.
+func (f *freshness) report() Freshness {
+	if f == nil {
+		return Freshness{}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.asOf.IsZero() {
+		return Freshness{}
+	}
+	return Freshness{AsOf: f.asOf.UTC().Format(time.RFC3339), Stale: f.stale}
+}
+
+// window returns when the newest section of the response was observed and
+// when the first of its data stops being fresh, both zero if nothing was
+// noted. datable reports whether the response only changes when the
+// observation time does: not while any data is stale, since it changes once
+// refreshed, or with sections that have no observation time.
+func (f *freshness) window() (observed, expires time.Time, datable bool) {
+	if f == nil {
+		return time.Time{}, time.Time{}, false
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.observed, f.expires, !f.stale && !f.unobserved
+}
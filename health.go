@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"weather-bff/cache"
+	"weather-bff/upstream"
+)
+
+// upstreamHealth keeps the recent outcomes of calls to each upstream for
+// /readyz.
+var upstreamHealth = upstream.NewHealth(readinessWindow)
+
+// An upstream fails readiness if its breaker is open, if it rejected our API
+// key on the last call, or if fewer than readinessMinSuccessRate of the calls
+// in the last readinessWindow succeeded, given at least readinessMinSamples
+// calls.
+const (
+	readinessWindow         = 5 * time.Minute
+	readinessMinSamples     = 5
+	readinessMinSuccessRate = 0.5
+)
+
+// readinessPingTimeout bounds the Redis ping, so a hung Redis doesn't hang
+// the router's health checks too.
+const readinessPingTimeout = time.Second
+
+// Check statuses. A failing critical check makes the BFF not ready; a
+// failing optional one only degrades it.
+const (
+	checkOK       = "ok"
+	checkDegraded = "degraded"
+	checkFailed   = "fail"
+)
+
+// UpstreamCheck is the readiness of one upstream.
+type UpstreamCheck struct {
+	Status   string                `json:"status"`
+	Critical bool                  `json:"critical"`
+	Host     string                `json:"host"`
+	Breaker  string                `json:"breaker"`
+	Reasons  []string              `json:"reasons,omitempty"`
+	Recent   upstream.HealthStatus `json:"recent"`
+}
+
+// CacheCheck is the state of the shared cache, which /readyz pings. Results
+// are cached in process while it is down, so it never fails readiness.
+type CacheCheck struct {
+	Status string `json:"status"`
+	cache.FallbackStatus
+}
+
+// ReadinessResponse is the body of /readyz.
+type ReadinessResponse struct {
+	Status    string                   `json:"status"`
+	Cache     *CacheCheck              `json:"cache,omitempty"`
+	Upstreams map[string]UpstreamCheck `json:"upstreams"`
+}
+
+// recordUpstreamHealth records the outcome of a call for readiness. An
+// unknown location is a healthy answer; a call the client gave up on, or one
+// shed for lack of quota, says nothing either way.
+func recordUpstreamHealth(provider, cause string) {
+	switch cause {
+	case "", "not_found":
+		upstreamHealth.Success(provider)
+	case "canceled", causeQuotaExhausted:
+	default:
+		upstreamHealth.Failure(provider, cause)
+	}
+}
+
+// healthzHandler reports that the process is up and serving. It checks
+// nothing else, so a flaky upstream never gets the dyno restarted.
+func healthzHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// readyzHandler reports whether the BFF can usefully serve traffic, with a
+// breakdown of every check.
+func readyzHandler(c *gin.Context) {
+	if isShuttingDown() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "shutting_down"})
+		return
+	}
+
+	resp := ReadinessResponse{
+		Status:    "ready",
+		Upstreams: make(map[string]UpstreamCheck),
+	}
+
+	if sharedCache != nil {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), readinessPingTimeout)
+		sharedCache.Ping(ctx)
+		cancel()
+		check := &CacheCheck{Status: checkOK, FallbackStatus: sharedCache.Status()}
+		if check.Down {
+			check.Status = checkDegraded
+		}
+		resp.Cache = check
+	}
+
+	breakers := upstreamTransport.Breakers()
+	upstreams := []struct {
+		name     string
+		baseURL  string
+		critical bool
+	}{
+		{weatherCache.Name(), cfg.OpenWeatherMap.BaseURL, true},
+		//The dashboard gets by without a fact
+		{factUpstream, cfg.Fact.BaseURL, false},
+	}
+	for _, u := range upstreams {
+		check := checkUpstream(u.name, u.baseURL, breakers)
+		check.Critical = u.critical
+		if check.Status == checkFailed && !u.critical {
+			check.Status = checkDegraded
+		}
+		if check.Status == checkFailed {
+			resp.Status = "not_ready"
+		}
+		resp.Upstreams[u.name] = check
+	}
+
+	status := http.StatusOK
+	if resp.Status != "ready" {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, resp)
+}
+
+func checkUpstream(name, baseURL string, breakers map[string]upstream.BreakerStatus) UpstreamCheck {
+	check := UpstreamCheck{Status: checkOK, Breaker: upstream.StateClosed}
+	if u, err := url.Parse(baseURL); err == nil {
+		check.Host = u.Host
+	}
+	if b, ok := breakers[check.Host]; ok {
+		check.Breaker = b.State
+	}
+	check.Recent = upstreamHealth.Status(name)
+
+	if check.Breaker == upstream.StateOpen {
+		check.Reasons = append(check.Reasons, "circuit breaker is open")
+	}
+	if !check.Recent.LastOK && check.Recent.LastFailure == "unauthorized" {
+		check.Reasons = append(check.Reasons, "API key was rejected")
+	}
+	if check.Recent.Samples >= readinessMinSamples && check.Recent.SuccessRate < readinessMinSuccessRate {
+		check.Reasons = append(check.Reasons, "most recent calls failed")
+	}
+	if len(check.Reasons) > 0 {
+		check.Status = checkFailed
+	}
+	return check
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// cachePolicy says how a successful response may be cached.
+type cachePolicy int
+
+const (
+	// cacheable responses are built from cached data alone, and can be
+	// reused for as long as it stays fresh.
+	cacheable cachePolicy = iota
+	// revalidate responses are missing a section, and must be revalidated
+	// every time.
+	revalidate
+	// uncacheable responses include data that is new on every request, like
+	// a fact, and must not be stored.
+	uncacheable
+)
+
+// respondCached writes a successful response built from cached weather data
+// with HTTP caching headers, so the apps and any CDN in between can reuse it
+// and revalidate it instead of downloading it again. The ETag is derived from
+// the body, Last-Modified is when the newest section was observed, and
+// Cache-Control allows reuse, as policy permits, for as long as the data
+// stays fresh in our cache. A request whose If-None-Match, or failing that
+// If-Modified-Since, matches gets a 304 without a body. If-Modified-Since is
+// ignored unless the body only changes with the observation time.
+func respondCached(c *gin.Context, body interface{}, policy cachePolicy) {
+	respondValidated(c, body, nil, policy)
+}
+
+// respondValidated is respondCached with the ETag derived from validator, if
+// not nil: body without the parts that are new on every request, like a
+// fact. Bodies that only differ in those share a weak ETag, so a client
+// revalidating gets a 304 and keeps the fact it has.
+func respondValidated(c *gin.Context, body, validator interface{}, policy cachePolicy) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not encode response"})
+		return
+	}
+
+	h := c.Writer.Header()
+	if policy == uncacheable {
+		h.Set("Cache-Control", "no-store")
+		c.Data(http.StatusOK, "application/json; charset=utf-8", data)
+		return
+	}
+
+	etag := contentETag(data)
+	if validator != nil {
+		validated, err := json.Marshal(validator)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "could not encode response"})
+			return
+		}
+		etag = "W/" + contentETag(validated)
+	}
+
+	lastModified, expires, datable := freshnessFrom(c.Request.Context()).window()
+	h.Set("ETag", etag)
+	if !lastModified.IsZero() {
+		h.Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+	h.Set("Cache-Control", cacheControl(expires, policy == cacheable))
+
+	if !datable {
+		lastModified = time.Time{}
+	}
+	if notModified(c.Request, etag, lastModified) {
+		c.Status(http.StatusNotModified)
+		c.Writer.WriteHeaderNow()
+		return
+	}
+	c.Data(http.StatusOK, "application/json; charset=utf-8", data)
+}
+
+// contentETag is a strong validator for a response body.
+func contentETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + base64.RawURLEncoding.EncodeToString(sum[:16]) + `"`
+}
+
+// cacheControl allows caching until expires, the earliest expiry of the data
+// behind a response. With authentication on, responses are only for the
+// client that asked for them; shared caches must not serve them to others.
+func cacheControl(expires time.Time, complete bool) string {
+	scope := "public"
+	if cfg.Auth.Enabled {
+		scope = "private"
+	}
+	if !complete || expires.IsZero() {
+		return scope + ", no-cache"
+	}
+
+	maxAge := int64(time.Until(expires) / time.Second)
+	if maxAge < 0 {
+		maxAge = 0
+	}
+	return scope + ", max-age=" + strconv.FormatInt(maxAge, 10)
+}
+
+// notModified evaluates the request's conditional headers, as in RFC 7232:
+// If-None-Match, compared weakly, takes precedence over If-Modified-Since.
+func notModified(r *http.Request, etag string, lastModified time.Time) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		return etagMatches(inm, etag)
+	}
+
+	ims := r.Header.Get("If-Modified-Since")
+	if ims == "" || lastModified.IsZero() {
+		return false
+	}
+	since, err := http.ParseTime(ims)
+	if err != nil {
+		return false
+	}
+	//Last-Modified only has second precision
+	return !lastModified.Truncate(time.Second).After(since)
+}
+
+// etagMatches reports whether an If-None-Match list contains etag, ignoring
+// weak prefixes.
+func etagMatches(list, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
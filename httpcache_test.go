@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"weather-bff/config"
+)
+
+// validatedResponse calls respondValidated for a GET carrying header, after
+// noting the observation times in observed.
+func validatedResponse(body, validator interface{}, header http.Header, observed ...int) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	r := httptest.NewRequest("GET", "/dashboard?q=london", nil)
+	for name, values := range header {
+		r.Header[name] = values
+	}
+	c.Request = r.WithContext(withFreshness(r.Context()))
+	for _, dt := range observed {
+		noteObserved(c.Request.Context(), dt)
+	}
+	respondValidated(c, body, validator, revalidate)
+	return w
+}
+
+func TestFactIsLeftOutOfTheETag(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	cfg = &config.Config{}
+
+	weather := &CurrentWeatherData{Name: "London", Dt: 1700000000}
+	first := DashboardResponse{WeatherConditions: weather, Fact: &Fact{Value: "one"}}
+	second := DashboardResponse{WeatherConditions: weather, Fact: &Fact{Value: "two"}}
+	withoutFact := DashboardResponse{WeatherConditions: weather}
+
+	w := validatedResponse(first, withoutFact, nil)
+	etag := w.Header().Get("ETag")
+	if etag == "" || etag[:2] != "W/" {
+		t.Fatalf("ETag = %q, want a weak one", etag)
+	}
+	if cc := w.Header().Get("Cache-Control"); cc != "public, no-cache" {
+		t.Errorf("Cache-Control = %q, want public, no-cache", cc)
+	}
+
+	w = validatedResponse(second, withoutFact, http.Header{"If-None-Match": {etag}})
+	if w.Code != http.StatusNotModified {
+		t.Errorf("another fact with the same weather: status %d, want 304", w.Code)
+	}
+
+	changed := DashboardResponse{WeatherConditions: &CurrentWeatherData{Name: "London", Dt: 1700000600}}
+	w = validatedResponse(changed, changed, http.Header{"If-None-Match": {etag}})
+	if w.Code != http.StatusOK {
+		t.Errorf("new weather: status %d, want 200", w.Code)
+	}
+}
+
+func TestLastModifiedIsObservationTime(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	cfg = &config.Config{}
+	body := DashboardResponse{WeatherConditions: &CurrentWeatherData{Dt: 1700000600}}
+	observed := time.Unix(1700000600, 0).UTC().Format(http.TimeFormat)
+
+	w := validatedResponse(body, nil, nil, 1700000000, 1700000600)
+	if got := w.Header().Get("Last-Modified"); got != observed {
+		t.Errorf("Last-Modified = %q, want the newest observation %q", got, observed)
+	}
+	w = validatedResponse(body, nil, http.Header{"If-Modified-Since": {observed}}, 1700000600)
+	if w.Code != http.StatusNotModified {
+		t.Errorf("If-Modified-Since the observation: status %d, want 304", w.Code)
+	}
+
+	//A section without an observation time can change without it moving
+	w = validatedResponse(body, nil, http.Header{"If-Modified-Since": {observed}}, 1700000600, 0)
+	if w.Code != http.StatusOK {
+		t.Errorf("with an unobserved section: status %d, want 200", w.Code)
+	}
+	if got := w.Header().Get("Last-Modified"); got != observed {
+		t.Errorf("with an unobserved section: Last-Modified = %q, want %q", got, observed)
+	}
+}
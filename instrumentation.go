@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"weather-bff/logging"
+	"weather-bff/metrics"
+	"weather-bff/quota"
+	"weather-bff/upstream"
+)
+
+// metricsRegistry backs GET /metrics.
+var metricsRegistry = metrics.NewRegistry()
+
+var (
+	httpRequests = metricsRegistry.NewCounterVec(
+		"weatherbff_http_requests_total",
+		"HTTP requests served, by route and status.",
+		"route", "status")
+	httpDuration = metricsRegistry.NewHistogramVec(
+		"weatherbff_http_request_duration_seconds",
+		"Time to serve HTTP requests, by route and status.",
+		metrics.DefBuckets, "route", "status")
+	upstreamDuration = metricsRegistry.NewHistogramVec(
+		"weatherbff_upstream_request_duration_seconds",
+		"Time taken by upstream calls, retries included, by provider and endpoint.",
+		metrics.DefBuckets, "provider", "endpoint")
+	upstreamErrors = metricsRegistry.NewCounterVec(
+		"weatherbff_upstream_errors_total",
+		"Failed upstream calls, by provider, endpoint and cause.",
+		"provider", "endpoint", "cause")
+	prefetchedLocations = metricsRegistry.NewCounterVec(
+		"weatherbff_prefetch_locations_total",
+		"Popular locations visited by the prefetcher, by result: warm, refreshed, failed or skipped for lack of quota.",
+		"result")
+
+	httpInFlight int64
+)
+
+// unmatchedRoute labels requests that didn't match a route, so scanners can't
+// blow up the cardinality of the route label.
+const unmatchedRoute = "unmatched"
+
+// registerStateMetrics exposes gauges and counters read from other components
+// at scrape time. It must run after those components are set up.
+func registerStateMetrics() {
+	metricsRegistry.NewGaugeFunc("weatherbff_http_requests_in_flight",
+		"HTTP requests currently being served.",
+		func() float64 { return float64(atomic.LoadInt64(&httpInFlight)) })
+	metricsRegistry.NewGaugeFunc("go_goroutines",
+		"Number of goroutines that currently exist.",
+		func() float64 { return float64(runtime.NumGoroutine()) })
+
+	metricsRegistry.NewFunc("weatherbff_cache_hits_total",
+		"Upstream results served from cache, by cache.",
+		"counter", []string{"cache"}, func() []metrics.Sample {
+			var samples []metrics.Sample
+			for name, stats := range weatherCache.Stats() {
+				samples = append(samples, metrics.Sample{LabelValues: []string{name}, Value: float64(stats.Hits)})
+			}
+			return samples
+		})
+	metricsRegistry.NewFunc("weatherbff_cache_misses_total",
+		"Upstream results that had to be fetched, by cache.",
+		"counter", []string{"cache"}, func() []metrics.Sample {
+			var samples []metrics.Sample
+			for name, stats := range weatherCache.Stats() {
+				samples = append(samples, metrics.Sample{LabelValues: []string{name}, Value: float64(stats.Misses)})
+			}
+			return samples
+		})
+	metricsRegistry.NewFunc("weatherbff_cache_stale_total",
+		"Results served past their TTL while being refreshed, by cache.",
+		"counter", []string{"cache"}, func() []metrics.Sample {
+			var samples []metrics.Sample
+			for name, stats := range weatherCache.Stats() {
+				samples = append(samples, metrics.Sample{LabelValues: []string{name}, Value: float64(stats.Stale)})
+			}
+			return samples
+		})
+	if sharedCache != nil {
+		metricsRegistry.NewGaugeFunc("weatherbff_cache_shared_up",
+			"Whether the shared cache is in use (1) or results are cached in process while it is down (0).",
+			func() float64 {
+				if sharedCache.Status().Down {
+					return 0
+				}
+				return 1
+			})
+	}
+	metricsRegistry.NewFunc("weatherbff_upstream_quota_remaining",
+		"Calls left across an upstream's API keys in the current window, or -1 if the window is uncapped.",
+		"gauge", []string{"provider", "window"}, func() []metrics.Sample {
+			status := owmQuota.Status(context.Background())
+			provider := weatherCache.Name()
+			return []metrics.Sample{
+				{LabelValues: []string{provider, "minute"}, Value: float64(status.RemainingMinute)},
+				{LabelValues: []string{provider, "day"}, Value: float64(status.RemainingDay)},
+			}
+		})
+	metricsRegistry.NewFunc("weatherbff_upstream_breaker_open",
+		"Whether the circuit breaker for an upstream host is open (1) or half open (0.5).",
+		"gauge", []string{"host"}, func() []metrics.Sample {
+			var samples []metrics.Sample
+			for host, status := range upstreamTransport.Breakers() {
+				value := 0.0
+				switch status.State {
+				case upstream.StateOpen:
+					value = 1
+				case upstream.StateHalfOpen:
+					value = 0.5
+				}
+				samples = append(samples, metrics.Sample{LabelValues: []string{host}, Value: value})
+			}
+			return samples
+		})
+}
+
+// routeMatcher returns the route label for a request path: the path itself
+// if it is a registered route, unmatchedRoute otherwise.
+func routeMatcher(router *gin.Engine) func(path string) string {
+	var once sync.Once
+	routes := make(map[string]bool)
+
+	return func(path string) string {
+		//Routes are all registered by the time the first request arrives
+		once.Do(func() {
+			for _, r := range router.Routes() {
+				routes[r.Path] = true
+			}
+		})
+		if routes[path] {
+			return path
+		}
+		return unmatchedRoute
+	}
+}
+
+// metricsMiddleware counts and times every request by route and status.
+func metricsMiddleware(router *gin.Engine) gin.HandlerFunc {
+	routeOf := routeMatcher(router)
+
+	return func(c *gin.Context) {
+		atomic.AddInt64(&httpInFlight, 1)
+		start := time.Now()
+
+		c.Next()
+
+		atomic.AddInt64(&httpInFlight, -1)
+
+		route := routeOf(c.Request.URL.Path)
+		status := strconv.Itoa(c.Writer.Status())
+		httpRequests.Inc(route, status)
+		httpDuration.Observe(time.Since(start).Seconds(), route, status)
+	}
+}
+
+// upstreamCall is an outbound call being measured and logged.
+type upstreamCall struct {
+	// ctx carries a logger with the call's provider, endpoint and location,
+	// so lines logged while making the call, such as retries, have them too.
+	ctx   context.Context
+	url   string
+	start time.Time
+
+	provider, endpoint string
+}
+
+// startUpstreamCall starts measuring a call to endpoint of provider for
+// location, which is empty if the call isn't about one. Issue the request
+// with the returned call's ctx and defer end.
+func startUpstreamCall(ctx context.Context, provider, endpoint, location, url string) *upstreamCall {
+	logger := logging.FromContext(ctx).With("provider", provider, "endpoint", endpoint)
+	if location != "" {
+		logger = logger.With("location", location)
+	}
+	return &upstreamCall{
+		ctx:      logging.NewContext(ctx, logger),
+		url:      url,
+		start:    time.Now(),
+		provider: provider,
+		endpoint: endpoint,
+	}
+}
+
+// end records the call as having ended with *errp. Calls shed for lack of
+// quota never reached the upstream, so they are counted but not timed.
+func (u *upstreamCall) end(errp *error) {
+	elapsed := time.Since(u.start)
+
+	logger := logging.FromContext(u.ctx)
+	if *errp == nil {
+		upstreamDuration.Observe(elapsed.Seconds(), u.provider, u.endpoint)
+		recordUpstreamHealth(u.provider, "")
+		logger.Debug("upstream call", "duration_ms", elapsed, "url", logging.Redact(u.url))
+		return
+	}
+
+	cause := upstreamErrorCause(*errp)
+	if cause != causeQuotaExhausted {
+		upstreamDuration.Observe(elapsed.Seconds(), u.provider, u.endpoint)
+	}
+	recordUpstreamHealth(u.provider, cause)
+	upstreamErrors.Inc(u.provider, u.endpoint, cause)
+	logger.Warn("upstream call failed", "duration_ms", elapsed, "url", logging.Redact(u.url),
+		"cause", cause, "error", *errp)
+}
+
+// causeQuotaExhausted is the cause of calls shed because no API key had
+// budget left.
+const causeQuotaExhausted = "quota_exhausted"
+
+// upstreamErrorCause classifies an upstream error for metrics.
+func upstreamErrorCause(err error) string {
+	if urlErr, ok := err.(*url.Error); ok {
+		switch {
+		case urlErr.Err == upstream.ErrCircuitOpen:
+			return "circuit_open"
+		case urlErr.Err == quota.ErrExhausted:
+			return causeQuotaExhausted
+		case urlErr.Err == context.Canceled:
+			return "canceled"
+		case urlErr.Timeout():
+			return "timeout"
+		}
+		return "transport"
+	}
+
+	switch e := err.(type) {
+	case *UpstreamStatusError:
+		switch {
+		case e.StatusCode >= 500:
+			return "http_5xx"
+		case e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden:
+			return "unauthorized"
+		case e.StatusCode == http.StatusTooManyRequests:
+			return "rate_limited"
+		}
+		return "http_4xx"
+	case *json.SyntaxError, *json.UnmarshalTypeError:
+		return "decode"
+	}
+
+	switch err {
+	case ErrLocationNotFound:
+		return "not_found"
+	case context.Canceled:
+		return "canceled"
+	case context.DeadlineExceeded:
+		return "timeout"
+	}
+	return "other"
+}
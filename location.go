@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Ways a Location can be specified.
+const (
+	LocationCoordinates = "coord"
+	LocationCity        = "city"
+	LocationZip         = "zip"
+)
+
+// Location is a validated, normalized place to fetch weather for. Exactly one
+// of Coordinates, City or Zip is meaningful, as indicated by Kind.
+type Location struct {
+	Kind        string
+	Coordinates Coordinates
+	City        string
+	Zip         string
+	// Country is an upper case ISO 3166 alpha-2 code. It is always set for
+	// zip codes and optional for cities.
+	Country string
+}
+
+// Key is a canonical form of l, suitable for cache keys and logs.
+func (l Location) Key() string {
+	switch l.Kind {
+	case LocationCoordinates:
+		return fmt.Sprintf("coord=%.4f,%.4f", l.Coordinates.Latitude, l.Coordinates.Longitude)
+	case LocationCity:
+		if l.Country != "" {
+			return "city=" + l.City + "," + l.Country
+		}
+		return "city=" + l.City
+	}
+	return "zip=" + l.Zip + "," + l.Country
+}
+
+var (
+	countryPattern = regexp.MustCompile(`^[A-Z]{2}$`)
+	zipPattern     = regexp.MustCompile(`^[0-9A-Z][0-9A-Z -]{1,9}$`)
+)
+
+const maxCityLength = 100
+
+// parseLocation builds a Location from the lat/lon, q, zip and country query
+// parameters. Exactly one of lat/lon, q or zip must be given. Zip codes
+// without a country are resolved in defaultCountry.
+func parseLocation(query func(string) string, defaultCountry string) (Location, error) {
+	lat, lon := query("lat"), query("lon")
+	q, zip := strings.TrimSpace(query("q")), strings.TrimSpace(query("zip"))
+	country := strings.ToUpper(strings.TrimSpace(query("country")))
+
+	given := 0
+	for _, set := range []bool{lat != "" || lon != "", q != "", zip != ""} {
+		if set {
+			given++
+		}
+	}
+	switch {
+	case given == 0:
+		return Location{}, errors.New("one of lat/lon, q or zip is required")
+	case given > 1:
+		return Location{}, errors.New("only one of lat/lon, q or zip may be given")
+	}
+
+	//Coordinates name a place on their own, so a country with them is
+	//either redundant or contradicts them
+	if country != "" && q == "" && zip == "" {
+		return Location{}, errors.New("country can't be given with lat/lon")
+	}
+	if country != "" && !countryPattern.MatchString(country) {
+		return Location{}, fmt.Errorf("country %q must be an ISO 3166 alpha-2 code", country)
+	}
+
+	switch {
+	case q != "":
+		return parseCity(q, country)
+	case zip != "":
+		if country == "" {
+			country = defaultCountry
+		}
+		zip = strings.ToUpper(zip)
+		if !zipPattern.MatchString(zip) {
+			return Location{}, fmt.Errorf("zip %q is not a valid postal code", zip)
+		}
+		return Location{Kind: LocationZip, Zip: zip, Country: country}, nil
+	}
+	return parseCoordinates(lat, lon)
+}
+
+// isFinite rules out the NaN and infinities ParseFloat accepts, which would
+// otherwise slip past range checks.
+func isFinite(f float64) bool {
+	return !math.IsNaN(f) && !math.IsInf(f, 0)
+}
+
+func parseCoordinates(lat, lon string) (Location, error) {
+	if lat == "" || lon == "" {
+		return Location{}, errors.New("lat and lon must be given together")
+	}
+
+	latitude, err := strconv.ParseFloat(lat, 64)
+	if err != nil || !isFinite(latitude) || latitude < -90 || latitude > 90 {
+		return Location{}, fmt.Errorf("lat %q must be a number between -90 and 90", lat)
+	}
+	longitude, err := strconv.ParseFloat(lon, 64)
+	if err != nil || !isFinite(longitude) || longitude < -180 || longitude > 180 {
+		return Location{}, fmt.Errorf("lon %q must be a number between -180 and 180", lon)
+	}
+
+	//Four decimals is ~11m, so nearby requests normalize to the same location
+	return Location{
+		Kind: LocationCoordinates,
+		Coordinates: Coordinates{
+			Latitude:  roundTo(latitude, 4),
+			Longitude: roundTo(longitude, 4),
+		},
+	}, nil
+}
+
+// parseCity accepts "city" or "city,country". The country may also come from
+// the country parameter, but not from both if they disagree.
+func parseCity(q, country string) (Location, error) {
+	parts := strings.Split(q, ",")
+	if len(parts) > 2 {
+		return Location{}, fmt.Errorf("q %q must be city or city,country", q)
+	}
+
+	city := strings.Join(strings.Fields(parts[0]), " ")
+	if city == "" || len(city) > maxCityLength {
+		return Location{}, fmt.Errorf("q %q must name a city", q)
+	}
+
+	if len(parts) == 2 {
+		inQuery := strings.ToUpper(strings.TrimSpace(parts[1]))
+		if !countryPattern.MatchString(inQuery) {
+			return Location{}, fmt.Errorf("country %q must be an ISO 3166 alpha-2 code", inQuery)
+		}
+		if country != "" && country != inQuery {
+			return Location{}, fmt.Errorf("q %q and country %q name different countries", q, country)
+		}
+		country = inQuery
+	}
+
+	return Location{Kind: LocationCity, City: strings.ToLower(city), Country: country}, nil
+}
+
+func roundTo(f float64, decimals int) float64 {
+	scale := math.Pow(10, float64(decimals))
+	return math.Round(f*scale) / scale
+}
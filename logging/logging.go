@@ -0,0 +1,225 @@
+// Package logging writes leveled, structured log lines as JSON objects, one
+// per line. Loggers carry fields, such as a request ID, that are added to
+// every line they write, and travel through contexts so code deep in a call
+// chain logs with the fields of the request it serves.
+//
+// Credentials in query strings (APPID=... and friends) are redacted from
+// every string and error value before it is written.
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log line.
+type Level int
+
+// Levels, from least to most severe.
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel parses a level name as written in log lines.
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q", s)
+}
+
+// output is shared by a logger and everything derived from it with With.
+type output struct {
+	mu    sync.Mutex
+	w     io.Writer
+	level Level
+}
+
+// Logger writes log lines with a fixed set of fields. It is safe for
+// concurrent use.
+type Logger struct {
+	out    *output
+	fields []interface{}
+}
+
+// New returns a Logger writing lines at level or above to w.
+func New(w io.Writer, level Level) *Logger {
+	return &Logger{out: &output{w: w, level: level}}
+}
+
+var std = New(os.Stdout, LevelInfo)
+
+// Default returns the logger used when a context carries none.
+func Default() *Logger {
+	return std
+}
+
+// SetDefault replaces the default logger. It is meant to be called once at
+// startup.
+func SetDefault(l *Logger) {
+	std = l
+}
+
+// With returns a logger that adds the key/value pairs in kv to every line.
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(append(fields, l.fields...), kv...)
+	return &Logger{out: l.out, fields: fields}
+}
+
+// Enabled reports whether lines at level are written.
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.out.level
+}
+
+// Debug logs msg with the key/value pairs in kv at LevelDebug.
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.log(LevelDebug, msg, kv) }
+
+// Info logs msg with the key/value pairs in kv at LevelInfo.
+func (l *Logger) Info(msg string, kv ...interface{}) { l.log(LevelInfo, msg, kv) }
+
+// Warn logs msg with the key/value pairs in kv at LevelWarn.
+func (l *Logger) Warn(msg string, kv ...interface{}) { l.log(LevelWarn, msg, kv) }
+
+// Error logs msg with the key/value pairs in kv at LevelError.
+func (l *Logger) Error(msg string, kv ...interface{}) { l.log(LevelError, msg, kv) }
+
+func (l *Logger) log(level Level, msg string, kv []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(`{"time":`)
+	writeValue(&buf, time.Now().UTC().Format(time.RFC3339Nano))
+	buf.WriteString(`,"level":`)
+	writeValue(&buf, level.String())
+	buf.WriteString(`,"msg":`)
+	writeValue(&buf, msg)
+	writeFields(&buf, l.fields)
+	writeFields(&buf, kv)
+	buf.WriteString("}\n")
+
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	l.out.w.Write(buf.Bytes())
+}
+
+func writeFields(buf *bytes.Buffer, kv []interface{}) {
+	for i := 0; i < len(kv); i += 2 {
+		key, ok := kv[i].(string)
+		if !ok {
+			key = fmt.Sprint(kv[i])
+		}
+		var value interface{} = "!MISSING"
+		if i+1 < len(kv) {
+			value = kv[i+1]
+		}
+
+		buf.WriteByte(',')
+		writeValue(buf, key)
+		buf.WriteByte(':')
+		writeValue(buf, value)
+	}
+}
+
+// writeValue writes v as JSON. Errors are written as their message and
+// durations as fractional milliseconds; anything JSON can't encode is
+// written as formatted by fmt.
+func writeValue(buf *bytes.Buffer, v interface{}) {
+	switch value := v.(type) {
+	case string:
+		v = Redact(value)
+	case error:
+		v = Redact(value.Error())
+	case time.Duration:
+		v = float64(value) / float64(time.Millisecond)
+	case time.Time:
+		v = value.UTC().Format(time.RFC3339Nano)
+	case fmt.Stringer:
+		v = Redact(value.String())
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		data, _ = json.Marshal(Redact(fmt.Sprint(v)))
+	}
+	buf.Write(data)
+}
+
+type loggerKey struct{}
+
+// NewContext returns a copy of ctx carrying l.
+func NewContext(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// FromContext returns the logger carried by ctx, or the default logger.
+func FromContext(ctx context.Context) *Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*Logger); ok {
+		return l
+	}
+	return Default()
+}
+
+// secretParams are query parameters carrying credentials.
+var secretParams = []string{"appid", "api_key", "apikey", "key", "token"}
+
+var secretPattern = regexp.MustCompile(`(?i)\b(` + strings.Join(secretParams, "|") + `)=[^&\s"]*`)
+
+// Redact replaces the values of credential query parameters anywhere in s.
+func Redact(s string) string {
+	if !strings.Contains(s, "=") {
+		return s
+	}
+	return secretPattern.ReplaceAllString(s, "${1}=REDACTED")
+}
+
+// RedactURL renders u with the values of credential query parameters
+// replaced.
+func RedactURL(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.String()
+	}
+
+	query := u.Query()
+	redacted := false
+	for name := range query {
+		for _, secret := range secretParams {
+			if strings.EqualFold(name, secret) {
+				query[name] = []string{"REDACTED"}
+				redacted = true
+			}
+		}
+	}
+	if !redacted {
+		return u.String()
+	}
+
+	clean := *u
+	clean.RawQuery = query.Encode()
+	return clean.String()
+}
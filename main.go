@@ -1,22 +1,52 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
+
+	"weather-bff/auth"
+	"weather-bff/cache"
+	"weather-bff/config"
+	"weather-bff/logging"
+	"weather-bff/quota"
+	"weather-bff/ratelimit"
+	"weather-bff/trace"
+	"weather-bff/upstream"
 )
 
-const openWeatherAPIKey = "b4608d4fcb4accac0a8cc2ea6949eeb5"
+// cfg is loaded and validated once at startup, before any handler runs.
+var cfg *config.Config
 
-var netClient = &http.Client{
-	Timeout: time.Second * 20,
-}
+var netClient *http.Client
+
+// upstreamTransport retries failed upstream calls and keeps a circuit breaker
+// per upstream host.
+var upstreamTransport *upstream.Transport
+
+// owmQuota hands out OpenWeatherMap API keys within the plan's quota.
+var owmQuota *quota.Manager
+
+// sharedCache is the Redis store behind weatherCache, or nil if results are
+// only cached in process.
+var sharedCache *cache.FallbackStore
+
+// weatherCache sits in front of the upstream provider so repeated requests for
+// a location within the TTLs don't leave the dyno.
+var weatherCache *CachingProvider
+
+// weatherProvider is the backend all weather, forecast and UV requests go
+// through.
+var weatherProvider WeatherProvider
 
 // Coordinates struct holds longitude and latitude data in returned
 // JSON or as parameter data for requests using longitude and latitude.
@@ -32,8 +62,29 @@ type Weather struct {
 	Main        string `json:"main"`
 	Description string `json:"description"`
 	Icon        string `json:"icon"`
+
+	// Provider independent fields, filled in by the WeatherProvider. Not
+	// part of the v1 schema.
+	Condition Condition `json:"-"`
+	IconURL   string    `json:"-"`
 }
 
+// Condition is a provider independent classification of the weather.
+type Condition string
+
+// Conditions reported in the v2 schema.
+const (
+	ConditionClear        Condition = "clear"
+	ConditionPartlyCloudy Condition = "partly_cloudy"
+	ConditionCloudy       Condition = "cloudy"
+	ConditionFog          Condition = "fog"
+	ConditionDrizzle      Condition = "drizzle"
+	ConditionRain         Condition = "rain"
+	ConditionSnow         Condition = "snow"
+	ConditionThunderstorm Condition = "thunderstorm"
+	ConditionUnknown      Condition = "unknown"
+)
+
 // Main struct contains the temperatures, humidity, pressure for the request.
 type Main struct {
 	Temp     float64 `json:"temp"`
@@ -51,10 +102,19 @@ type CurrentWeatherData struct {
 	ID      int         `json:"id"`
 	Name    string      `json:"name"`
 	Cod     int         `json:"cod"`
+
+	// Precipitation is the rain and snow in mm over the period the entry
+	// covers, and PrecipitationChance its probability from 0 to 1 (forecast
+	// entries only). Not part of the v1 schema.
+	Precipitation       float64 `json:"-"`
+	PrecipitationChance float64 `json:"-"`
 }
 
 type WeatherForecast struct {
 	List []CurrentWeatherData `json:"list"`
+
+	// TimezoneOffset is the location's offset from UTC in seconds.
+	TimezoneOffset int `json:"-"`
 }
 
 type Fact struct {
@@ -67,86 +127,223 @@ type UVIndex struct {
 	ColorValue  string  `json:"colorValue"`
 }
 
-//JSON struct for response to the dashboard endpoint
+//JSON struct for response to the dashboard endpoint. Sections that could not
+//be fetched are omitted and described in Errors instead.
 type DashboardResponse struct {
-	WeatherConditions CurrentWeatherData
-	Fact              Fact
-	UVIndex           UVIndex
-	WeatherForecast   WeatherForecast
+	WeatherConditions *CurrentWeatherData     `json:",omitempty"`
+	Fact              *Fact                   `json:",omitempty"`
+	UVIndex           *UVIndex                `json:",omitempty"`
+	WeatherForecast   *WeatherForecast        `json:",omitempty"`
+	Daily             []DailySummary          `json:"daily,omitempty"`
+	Units             UnitSystem              `json:"units"`
+	Lang              string                  `json:"lang,omitempty"`
+	Errors            map[string]SectionError `json:"errors,omitempty"`
+	Freshness
 }
 
-//TODO: determine what info is needed and restruct the response to only the necessary info
-func GetWeather(ch chan<- CurrentWeatherData, ch3 chan<- UVIndex, zip string) {
-
-	var weatherResponse CurrentWeatherData
+// SectionError explains why a section of the dashboard is missing.
+type SectionError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
 
-	location := zip + ",US"
-	units := "imperial"
+// Section error codes.
+const (
+	errCodeNotFound   = "not_found"
+	errCodeUpstream   = "upstream_unavailable"
+	errCodeTimeout    = "timeout"
+	errCodeDependency = "dependency_failed"
+	errCodeCircuit    = "circuit_open"
+	errCodeQuota      = "quota_exhausted"
+)
 
-	url := fmt.Sprintf("http://api.openweathermap.org/data/2.5/weather?zip=%s&units=%s&APPID=%s", location, units, openWeatherAPIKey)
+var errWeatherUnavailable = errors.New("current weather unavailable")
 
-	resp, _ := netClient.Get(url)
+// The section errors clients see, one per code.
+var (
+	notFoundSectionError   = SectionError{Code: errCodeNotFound, Message: ErrLocationNotFound.Error()}
+	upstreamSectionError   = SectionError{Code: errCodeUpstream, Message: "upstream is unavailable"}
+	timeoutSectionError    = SectionError{Code: errCodeTimeout, Message: "upstream did not respond in time"}
+	dependencySectionError = SectionError{Code: errCodeDependency, Message: errWeatherUnavailable.Error()}
+	circuitSectionError    = SectionError{Code: errCodeCircuit, Message: "upstream is unavailable, try again later"}
+	quotaSectionError      = SectionError{Code: errCodeQuota, Message: "upstream quota exhausted, try again later"}
+)
 
-	body, _ := ioutil.ReadAll(resp.Body)
-	err := json.Unmarshal(body, &weatherResponse)
-	if err == nil {
-		//This is dependent, so kick it off once we have the lat\longitude
-		//Probably not the best place.
-		go GetUVIndex(ch3, weatherResponse.GeoPos.Latitude, weatherResponse.GeoPos.Longitude)
-		ch <- weatherResponse
-	} else {
-		log.Output(1, "Error "+err.Error())
-		close(ch)
-		close(ch3)
+// weatherBudgetShare is the share of a request's remaining time the current
+// weather call may use when the UV index still has to be fetched after it.
+const weatherBudgetShare = 0.6
+
+// sectionErrorStatus is the HTTP status for an endpoint serving only the
+// section that failed with e.
+func sectionErrorStatus(e SectionError) int {
+	switch e.Code {
+	case errCodeNotFound:
+		return http.StatusNotFound
+	case errCodeTimeout:
+		return http.StatusGatewayTimeout
+	case errCodeCircuit, errCodeQuota:
+		return http.StatusServiceUnavailable
 	}
+	return http.StatusBadGateway
 }
 
-func GetForecast(ch chan<- WeatherForecast, zip string) {
-	var forecastResponse WeatherForecast
+// Each fetcher finishes with exactly one of these, carrying either data or err.
+type weatherResult struct {
+	data CurrentWeatherData
+	err  error
+}
 
-	location := zip + ",US"
-	units := "imperial"
+type forecastResult struct {
+	data WeatherForecast
+	err  error
+}
 
-	url := fmt.Sprintf("http://api.openweathermap.org/data/2.5/forecast?zip=%s&units=%s&APPID=%s", location, units, openWeatherAPIKey)
+type factResult struct {
+	data Fact
+	err  error
+}
 
-	resp, _ := netClient.Get(url)
+type uvResult struct {
+	data UVIndex
+	err  error
+}
 
-	body, _ := ioutil.ReadAll(resp.Body)
-	err := json.Unmarshal(body, &forecastResponse)
-	if err == nil {
-		ch <- forecastResponse
-	} else {
-		log.Output(1, "Error "+err.Error())
-		close(ch)
+func newSectionError(err error) SectionError {
+	//Only fixed messages reach clients: transport errors name internal hosts
+	//and embed the request URL, which carries the API key. The error itself
+	//is logged with the request ID by logSectionError.
+	if urlErr, ok := err.(*url.Error); ok {
+		switch {
+		case urlErr.Err == upstream.ErrCircuitOpen:
+			return circuitSectionError
+		case urlErr.Err == quota.ErrExhausted:
+			return quotaSectionError
+		case urlErr.Timeout():
+			return timeoutSectionError
+		}
+		return upstreamSectionError
 	}
+
+	switch err {
+	case context.DeadlineExceeded, context.Canceled:
+		return timeoutSectionError
+	case ErrLocationNotFound:
+		return notFoundSectionError
+	case errWeatherUnavailable:
+		return dependencySectionError
+	}
+	return upstreamSectionError
 }
 
-func GetFact(ch chan<- Fact) {
+// logSectionError logs why section couldn't be fetched for location. Unknown
+// locations are the caller's problem, not ours, so they aren't errors.
+func logSectionError(ctx context.Context, section, location string, err error) {
+	logger := logging.FromContext(ctx)
+	if err == ErrLocationNotFound {
+		logger.Info("location not found", "section", section, "location", location)
+		return
+	}
+	logger.Error("section unavailable", "section", section, "location", location, "error", err)
+}
 
-	var factResponse Fact
+// budgetShare returns a child of ctx that expires after share of ctx's
+// remaining time, leaving the rest for calls that have to run after it.
+func budgetShare(ctx context.Context, share float64) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, time.Duration(float64(time.Until(deadline))*share))
+}
 
-	url := "https://api.chucknorris.io/jokes/random?category=science"
+//Returns the full provider data; /v2/dashboard trims it down to what the app needs.
+//Pass a nil ch3 to skip the dependent UV index call.
+func GetWeather(ctx context.Context, p WeatherProvider, ch chan<- weatherResult, ch3 chan<- uvResult, loc Location, opts RequestOptions) {
+	weatherCtx, cancel := ctx, context.CancelFunc(func() {})
+	if ch3 != nil {
+		weatherCtx, cancel = budgetShare(ctx, weatherBudgetShare)
+	}
+	weatherResponse, err := p.CurrentWeather(weatherCtx, loc, opts)
+	cancel()
 
-	resp, _ := netClient.Get(url)
+	if err == nil {
+		//This is dependent, so kick it off once we have the lat\longitude
+		//Probably not the best place.
+		if ch3 != nil {
+			go GetUVIndex(ctx, p, ch3, weatherResponse.GeoPos.Latitude, weatherResponse.GeoPos.Longitude)
+		}
+		ch <- weatherResult{data: weatherResponse}
+	} else {
+		logSectionError(ctx, sectionCurrent, loc.Key(), err)
+		ch <- weatherResult{err: err}
+		if ch3 != nil {
+			uvErr := errWeatherUnavailable
+			if err == ErrLocationNotFound {
+				uvErr = err
+			}
+			ch3 <- uvResult{err: uvErr}
+		}
+	}
+}
 
-	body, _ := ioutil.ReadAll(resp.Body)
-	err := json.Unmarshal(body, &factResponse)
+func GetForecast(ctx context.Context, p WeatherProvider, ch chan<- forecastResult, loc Location, opts RequestOptions) {
+	forecastResponse, err := p.Forecast(ctx, loc, opts)
 	if err == nil {
-		ch <- factResponse
+		ch <- forecastResult{data: forecastResponse}
 	} else {
-		log.Output(1, "Error "+err.Error())
+		logSectionError(ctx, sectionForecast, loc.Key(), err)
+		ch <- forecastResult{err: err}
 	}
 }
 
-func GetUVIndex(ch chan<- UVIndex, lat float64, long float64) {
-	var qualityResponse UVIndex
+// factUpstream names the fact API in metrics and errors.
+const factUpstream = "chucknorris"
+
+func GetFact(ctx context.Context, ch chan<- factResult) {
+	factResponse, err := fetchFact(ctx)
+	if err == nil {
+		ch <- factResult{data: factResponse}
+	} else {
+		logSectionError(ctx, sectionFact, "", err)
+		ch <- factResult{err: err}
+	}
+}
 
-	url := fmt.Sprintf("http://api.openweathermap.org/data/2.5/uvi?lat=%f&lon=%f&APPID=%s", lat, long, openWeatherAPIKey)
+func fetchFact(ctx context.Context) (factResponse Fact, err error) {
+	url := cfg.Fact.BaseURL + "/jokes/random?category=science"
 
-	resp, _ := netClient.Get(url)
+	call := startUpstreamCall(ctx, factUpstream, "fact", "", url)
+	defer call.end(&err)
 
-	body, _ := ioutil.ReadAll(resp.Body)
-	err := json.Unmarshal(body, &qualityResponse)
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return factResponse, err
+	}
+	//Sent as a header rather than in the URL, which gets logged
+	if cfg.Fact.APIKey != "" {
+		req.Header.Set("X-Api-Key", cfg.Fact.APIKey)
+	}
+
+	resp, err := netClient.Do(req.WithContext(call.ctx))
+	if err != nil {
+		return factResponse, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return factResponse, &UpstreamStatusError{Upstream: factUpstream, StatusCode: resp.StatusCode}
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return factResponse, err
+	}
+	err = json.Unmarshal(body, &factResponse)
+	return factResponse, err
+}
+
+func GetUVIndex(ctx context.Context, p WeatherProvider, ch chan<- uvResult, lat float64, long float64) {
+	qualityResponse, err := p.UVIndex(ctx, lat, long)
 	if err == nil {
 
 		//Map color into response. Business logic should be in this layer, not in the app that calls it
@@ -171,42 +368,329 @@ func GetUVIndex(ch chan<- UVIndex, lat float64, long float64) {
 			qualityResponse.ColorValue = "Blue"
 		}
 
-		ch <- qualityResponse
+		ch <- uvResult{data: qualityResponse}
 	} else {
-		log.Output(1, "Error "+err.Error())
-		close(ch)
+		logSectionError(ctx, sectionUV, fmt.Sprintf("%.4f,%.4f", lat, long), err)
+		ch <- uvResult{err: err}
+	}
+}
+
+// Dashboard sections. Fan-out errors are keyed by these names.
+const (
+	sectionCurrent  = "current"
+	sectionForecast = "forecast"
+	sectionUV       = "uv"
+	sectionFact     = "fact"
+	sectionDaily    = "daily"
+)
+
+// v1SectionNames maps sections to the field names /dashboard reports errors
+// under.
+var v1SectionNames = map[string]string{
+	sectionCurrent:  "WeatherConditions",
+	sectionForecast: "WeatherForecast",
+	sectionUV:       "UVIndex",
+	sectionFact:     "Fact",
+	sectionDaily:    "daily",
+}
+
+// dashboardSections are the sections a dashboard can include. /dashboard
+// also has the daily summaries, which /v2/dashboard serves as its forecast.
+var (
+	dashboardSections   = []string{sectionCurrent, sectionForecast, sectionUV, sectionFact}
+	v1DashboardSections = []string{sectionCurrent, sectionForecast, sectionDaily, sectionUV, sectionFact}
+)
+
+// parseSections turns the include or exclude query values, comma separated
+// section names out of available, into the set of sections to return. With
+// neither given, every section is included.
+func parseSections(include, exclude string, available []string) (map[string]bool, error) {
+	if include != "" && exclude != "" {
+		return nil, errors.New("only one of include or exclude may be given")
+	}
+
+	sections := make(map[string]bool, len(available))
+	for _, section := range available {
+		sections[section] = include == ""
+	}
+
+	list, want := include, true
+	if exclude != "" {
+		list, want = exclude, false
+	}
+	if list == "" {
+		return sections, nil
+	}
+
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if _, ok := sections[name]; !ok {
+			return nil, fmt.Errorf("unknown section %q, must be one of %s", name, strings.Join(available, ", "))
+		}
+		sections[name] = want
 	}
+	return sections, nil
+}
+
+// dashboardData is the outcome of the upstream fan-out, shared by every
+// version of the dashboard. Sections that failed are nil and have an entry in
+// errors instead.
+type dashboardData struct {
+	sections map[string]bool
+	weather  *CurrentWeatherData
+	forecast *WeatherForecast
+	uv       *UVIndex
+	fact     *Fact
+	errors   map[string]SectionError
+}
+
+// respond writes body, the dashboard built from d, with d's status.
+// withoutFact is body with the fact left out, which is new every time: only
+// the rest is validated, so a dashboard with a fact can be revalidated but
+// not reused without. Only a 200 can be cached.
+func (d dashboardData) respond(c *gin.Context, body, withoutFact interface{}) {
+	status := d.status()
+	if status != http.StatusOK {
+		c.JSON(status, body)
+		return
+	}
+	d.noteObserved(c.Request.Context())
+
+	if d.fact == nil {
+		policy := cacheable
+		if len(d.errors) > 0 {
+			policy = revalidate
+		}
+		respondCached(c, body, policy)
+		return
+	}
+	respondValidated(c, body, withoutFact, revalidate)
+}
+
+// noteObserved records when the requested sections were observed. Only the
+// current weather has an observation time; the fact isn't validated.
+func (d dashboardData) noteObserved(ctx context.Context) {
+	for section, requested := range d.sections {
+		switch {
+		case !requested || section == sectionFact:
+		case section == sectionCurrent:
+			if d.weather != nil {
+				noteObserved(ctx, d.weather.Dt)
+			}
+		default:
+			noteObserved(ctx, 0)
+		}
+	}
+}
+
+// status picks the HTTP status for a dashboard built from d: 404 for an
+// unknown location, 502 if none of the requested sections could be fetched,
+// otherwise 200.
+func (d dashboardData) status() int {
+	for _, e := range d.errors {
+		if e.Code == errCodeNotFound {
+			return http.StatusNotFound
+		}
+	}
+	if d.weather == nil && d.forecast == nil && d.uv == nil && d.fact == nil && len(d.errors) > 0 {
+		return http.StatusBadGateway
+	}
+	return http.StatusOK
+}
+
+// parseDashboardRequest reads the location and rendering options from the
+// query string. On failure it has already written a 400 and returns false.
+func parseDashboardRequest(c *gin.Context) (Location, RequestOptions, bool) {
+	loc, err := parseLocation(c.Query, cfg.Country)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return Location{}, RequestOptions{}, false
+	}
+
+	opts, err := parseRequestOptions(c.Query("units"), c.Query("lang"), cfg.Units)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return Location{}, RequestOptions{}, false
+	}
+
+	return loc, opts, true
+}
+
+// parseSectionsRequest reads include/exclude, naming sections out of
+// available, from the query string. On failure it has already written a 400
+// and returns false.
+func parseSectionsRequest(c *gin.Context, available []string) (map[string]bool, bool) {
+	sections, err := parseSections(c.Query("include"), c.Query("exclude"), available)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	return sections, true
+}
+
+// requestContext bounds the upstream calls made for a request: they are
+// cancelled when the client goes away or the dashboard deadline passes. It
+// also starts tracking the freshness of the data the response is built from.
+func requestContext(c *gin.Context) (context.Context, context.CancelFunc) {
+	c.Request = c.Request.WithContext(withFreshness(c.Request.Context()))
+	return context.WithTimeout(c.Request.Context(), cfg.Timeouts.Dashboard)
+}
+
+// fetchDashboard fans out to the upstreams behind the requested sections and
+// waits for them until ctx is done. Sections not requested stay nil. The
+// daily summaries are built from the forecast, so it is fetched for either,
+// and its errors are reported under both. Any upstream calls still running
+// when it returns are cancelled.
+func fetchDashboard(ctx context.Context, loc Location, opts RequestOptions, sections map[string]bool) dashboardData {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	//Channels stay nil for sections that weren't requested; the rest are
+	//buffered so fetchers never block if we stop listening at the deadline
+	var ch chan weatherResult
+	var ch2 chan factResult
+	var ch3 chan uvResult
+	var ch4 chan forecastResult
+
+	//With coordinates UV doesn't have to wait for the current weather
+	var uvAfterWeather chan uvResult
+	if sections[sectionUV] {
+		ch3 = make(chan uvResult, 1)
+		if loc.Kind == LocationCoordinates {
+			go GetUVIndex(ctx, weatherProvider, ch3, loc.Coordinates.Latitude, loc.Coordinates.Longitude)
+		} else {
+			uvAfterWeather = ch3
+		}
+	}
+	if sections[sectionCurrent] || uvAfterWeather != nil {
+		weatherCh := make(chan weatherResult, 1)
+		if sections[sectionCurrent] {
+			ch = weatherCh
+		}
+		go GetWeather(ctx, weatherProvider, weatherCh, uvAfterWeather, loc, opts)
+	}
+	if sections[sectionForecast] || sections[sectionDaily] {
+		ch4 = make(chan forecastResult, 1)
+		go GetForecast(ctx, weatherProvider, ch4, loc, opts)
+	}
+	if sections[sectionFact] {
+		ch2 = make(chan factResult, 1)
+		go GetFact(ctx, ch2)
+	}
+
+	data := dashboardData{sections: sections, errors: make(map[string]SectionError)}
+	forecastFailed := func(e SectionError) {
+		for _, section := range []string{sectionForecast, sectionDaily} {
+			if sections[section] {
+				data.errors[section] = e
+			}
+		}
+	}
+
+	for ch != nil || ch2 != nil || ch3 != nil || ch4 != nil {
+		select {
+		case r := <-ch:
+			ch = nil
+			if r.err != nil {
+				data.errors[sectionCurrent] = newSectionError(r.err)
+			} else {
+				data.weather = &r.data
+			}
+		case r := <-ch4:
+			ch4 = nil
+			if r.err != nil {
+				forecastFailed(newSectionError(r.err))
+			} else {
+				data.forecast = &r.data
+			}
+		case r := <-ch2:
+			ch2 = nil
+			if r.err != nil {
+				data.errors[sectionFact] = newSectionError(r.err)
+			} else {
+				data.fact = &r.data
+			}
+		case r := <-ch3:
+			ch3 = nil
+			if r.err != nil {
+				data.errors[sectionUV] = newSectionError(r.err)
+			} else {
+				data.uv = &r.data
+			}
+		case <-ctx.Done():
+			//Sections still outstanding at the deadline are reported as timeouts
+			if ch != nil {
+				data.errors[sectionCurrent] = timeoutSectionError
+			}
+			if ch4 != nil {
+				forecastFailed(timeoutSectionError)
+			}
+			if ch2 != nil {
+				data.errors[sectionFact] = timeoutSectionError
+			}
+			if ch3 != nil {
+				data.errors[sectionUV] = timeoutSectionError
+			}
+			ch, ch2, ch3, ch4 = nil, nil, nil, nil
+		}
+	}
+
+	return data
 }
 
 func dashboardHandler(c *gin.Context) {
-	zip := c.Query("zip")
-
-	ch := make(chan CurrentWeatherData)
-	ch2 := make(chan Fact)
-	ch3 := make(chan UVIndex)
-	ch4 := make(chan WeatherForecast)
-
-	go GetWeather(ch, ch3, zip)
-	go GetForecast(ch4, zip)
-	go GetFact(ch2)
-
-	var weatherResponse = <-ch
-	var forecastResponse = <-ch4
-	var factResponse = <-ch2
-	var uviResponse = <-ch3
-
-	//TODO: Proper error handling if one of the responses is nil
-	//This is probably bare minimum
-	if weatherResponse.Cod == 200 {
-		respJSON := DashboardResponse{WeatherConditions: weatherResponse,
-			Fact:            factResponse,
-			UVIndex:         uviResponse,
-			WeatherForecast: forecastResponse}
-
-		c.JSON(http.StatusOK, respJSON)
-	} else {
-		c.JSON(http.StatusBadRequest, "")
+	loc, opts, ok := parseDashboardRequest(c)
+	if !ok {
+		return
 	}
+	sections, ok := parseSectionsRequest(c, v1DashboardSections)
+	if !ok {
+		return
+	}
+
+	popularLocations.record(loc, opts, sections)
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	data := fetchDashboard(ctx, loc, opts, sections)
+
+	respJSON := DashboardResponse{
+		WeatherConditions: data.weather,
+		Fact:              data.fact,
+		UVIndex:           data.uv,
+		Units:             unitSystems[opts.Units],
+		Lang:              opts.Lang,
+		Freshness:         freshnessFrom(ctx).report(),
+	}
+	//The forecast may only have been fetched for the daily summaries
+	if data.forecast != nil && sections[sectionForecast] {
+		respJSON.WeatherForecast = data.forecast
+	}
+	if data.forecast != nil && sections[sectionDaily] {
+		respJSON.Daily = aggregateDaily(*data.forecast)
+	}
+	if len(data.errors) > 0 {
+		respJSON.Errors = make(map[string]SectionError, len(data.errors))
+		for section, sectionErr := range data.errors {
+			respJSON.Errors[v1SectionNames[section]] = sectionErr
+		}
+	}
+
+	withoutFact := respJSON
+	withoutFact.Fact = nil
+	data.respond(c, respJSON, withoutFact)
+}
+
+func cacheStatsHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, weatherCache.Stats())
+}
+
+func upstreamStatsHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"breakers": upstreamTransport.Breakers()})
+}
+
+func quotaStatsHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{weatherCache.Name(): owmQuota.Status(c.Request.Context())})
 }
 
 func getIndex(c *gin.Context) {
@@ -214,18 +698,125 @@ func getIndex(c *gin.Context) {
 }
 
 func main() {
-	port := os.Getenv("PORT")
+	var err error
+	cfg, err = config.Load()
+	if err != nil {
+		logging.Default().Error("invalid configuration", "error", err)
+		os.Exit(1)
+	}
+	//Validate has already checked the level
+	level, _ := logging.ParseLevel(cfg.Logging.Level)
+	logging.SetDefault(logging.New(os.Stdout, level))
+
+	//Shutdown hooks run in registration order, and the prefetcher uses the
+	//Redis and tracer closed by later ones, so it is stopped first
+	prefetchCtx, stopPrefetch := context.WithCancel(context.Background())
+	prefetchDone := make(chan struct{})
+	onShutdown("prefetch", func(ctx context.Context) error {
+		stopPrefetch()
+		select {
+		case <-prefetchDone:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
 
-	if port == "" {
-		log.Fatal("$PORT must be set")
+	redis, err := newRedisStore(cfg.Cache)
+	if err != nil {
+		logging.Default().Error("invalid cache configuration", "error", err)
+		os.Exit(1)
+	}
+	//Redis, when configured, counts spend for every dyno
+	var spend quota.Counter
+	if redis != nil {
+		spend = redis
+	}
+	owmQuota = quota.NewManager(cfg.OpenWeatherMap.Keys(), quota.Limits(cfg.Quota), spend)
+
+	//No client-wide Timeout: each attempt is bounded by the transport and the
+	//whole call, retries included, by the request's context. Keys are added
+	//under the retries, so every attempt is charged to the quota
+	owmHost, _ := url.Parse(cfg.OpenWeatherMap.BaseURL)
+	keyTransport := &quota.Transport{Next: http.DefaultTransport, Manager: owmQuota, Host: owmHost.Host, Param: "APPID"}
+	upstreamTransport = upstream.NewTransport(keyTransport, upstream.Policy{
+		MaxAttempts:      cfg.Resilience.MaxAttempts,
+		BaseDelay:        cfg.Resilience.RetryBaseDelay,
+		MaxDelay:         cfg.Resilience.RetryMaxDelay,
+		AttemptTimeout:   cfg.Timeouts.Upstream,
+		FailureThreshold: cfg.Resilience.BreakerThreshold,
+		OpenTimeout:      cfg.Resilience.BreakerOpenTimeout,
+	})
+	tracer = newTracer(cfg.Tracing)
+	onShutdown("tracer", tracer.Shutdown)
+	netClient = &http.Client{
+		//Outermost, so one span covers a call and all its retries
+		Transport: &trace.Transport{Next: upstreamTransport, Tracer: tracer, FormatURL: logging.RedactURL},
+	}
+	var store cache.Store
+	store, sharedCache = newCacheStore(redis)
+	weatherCache = NewCachingProvider(NewOpenWeatherMap(cfg.OpenWeatherMap, cfg.Units, netClient), cfg.Cache, store, cfg.Timeouts.Dashboard)
+	weatherProvider = weatherCache
+	registerStateMetrics()
+
+	if cfg.Prefetch.Enabled {
+		prefetch := &prefetcher{
+			provider: weatherCache,
+			quota:    owmQuota,
+			popular:  popularLocations,
+			cfg:      cfg.Prefetch,
+			timeout:  cfg.Timeouts.Dashboard,
+		}
+		go func() {
+			defer close(prefetchDone)
+			prefetch.run(prefetchCtx)
+		}()
+	} else {
+		close(prefetchDone)
 	}
 
 	router := gin.New()
-	router.Use(gin.Logger())
+	router.Use(tracingMiddleware(router))
+	router.Use(requestIDMiddleware(router))
+	router.Use(accessLogMiddleware)
+	router.Use(metricsMiddleware(router))
+	if cfg.Compression.Enabled {
+		router.Use(compressionMiddleware(cfg.Compression))
+	}
+	limits := ratelimit.NewMemoryStore()
+	if cfg.Auth.Enabled {
+		if cfg.RateLimit.Enabled {
+			router.Use(authFailureLimitMiddleware(ratelimit.Limit(cfg.RateLimit.AuthFailures), limits))
+		}
+		router.Use(authMiddleware(router, auth.New(cfg.Auth)))
+	}
+	if cfg.RateLimit.Enabled {
+		router.Use(rateLimitMiddleware(router, cfg.RateLimit, limits))
+	}
 	router.LoadHTMLGlob("templates/*.tmpl.html")
 
-	router.GET("/", getIndex)
-	router.GET("/dashboard", dashboardHandler)
+	route(router, "/", scopePublic, getIndex)
+	route(router, "/healthz", scopePublic, healthzHandler)
+	route(router, "/readyz", scopePublic, readyzHandler)
+	route(router, "/dashboard", scopeWeather, dashboardHandler)
+	route(router, "/v2/dashboard", scopeWeather, dashboardV2Handler)
+	route(router, "/current", scopeWeather, currentHandler)
+	route(router, "/forecast", scopeWeather, forecastHandler)
+	route(router, "/daily", scopeWeather, dailyHandler)
+	route(router, "/uv", scopeWeather, uvHandler)
+	route(router, "/fact", scopeFact, factHandler)
+	//The debug routes show internals and what locations are asked for, so
+	//they are kept to ops keys unless turned on explicitly
+	if cfg.Auth.Enabled || cfg.DebugRoutes {
+		route(router, "/debug/cache", scopeOps, cacheStatsHandler)
+		route(router, "/debug/upstreams", scopeOps, upstreamStatsHandler)
+		route(router, "/debug/quota", scopeOps, quotaStatsHandler)
+		route(router, "/debug/prefetch", scopeOps, prefetchStatsHandler)
+	}
+	route(router, "/metrics", scopeOps, gin.WrapH(metricsRegistry))
 
-	router.Run(":" + port)
+	if err := serve(":"+cfg.Port, router, cfg.Timeouts.Shutdown); err != nil {
+		logging.Default().Error("server failed", "error", err)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,281 @@
+// Package metrics is a minimal metrics registry that renders the Prometheus
+// text exposition format. It supports labeled counters and histograms, plus
+// families whose samples are computed at scrape time.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefBuckets are latency buckets in seconds suited to HTTP calls.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Sample is one value of a family, identified by its label values.
+type Sample struct {
+	LabelValues []string
+	Value       float64
+}
+
+// family is anything the registry can render.
+type family interface {
+	write(w io.Writer)
+}
+
+// Registry holds metric families and renders them in registration order.
+type Registry struct {
+	mu       sync.Mutex
+	families []family
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(f family) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.families = append(r.families, f)
+}
+
+// WriteTo renders every family in the text exposition format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	families := append([]family(nil), r.families...)
+	r.mu.Unlock()
+
+	var buf bytes.Buffer
+	for _, f := range families {
+		f.write(&buf)
+	}
+	return buf.WriteTo(w)
+}
+
+// ServeHTTP serves the registry for Prometheus to scrape.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+// CounterVec is a counter partitioned by labels.
+type CounterVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]*Sample
+}
+
+// NewCounterVec registers a counter family.
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{name: name, help: help, labels: labels, values: make(map[string]*Sample)}
+	r.register(c)
+	return c
+}
+
+// Inc adds one to the counter with labelValues.
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v, which must not be negative, to the counter with labelValues.
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s, ok := c.values[key]
+	if !ok {
+		s = &Sample{LabelValues: append([]string(nil), labelValues...)}
+		c.values[key] = s
+	}
+	s.Value += v
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.mu.Lock()
+	samples := make([]Sample, 0, len(c.values))
+	for _, s := range c.values {
+		samples = append(samples, *s)
+	}
+	c.mu.Unlock()
+
+	writeFamily(w, c.name, c.help, "counter", c.labels, samples)
+}
+
+// HistogramVec is a histogram partitioned by labels.
+type HistogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	values map[string]*histogram
+}
+
+type histogram struct {
+	labelValues []string
+	counts      []uint64 // per bucket, not cumulative
+	count       uint64
+	sum         float64
+}
+
+// NewHistogramVec registers a histogram family with the given upper bounds,
+// which must be sorted.
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{name: name, help: help, labels: labels, buckets: buckets, values: make(map[string]*histogram)}
+	r.register(h)
+	return h
+}
+
+// Observe records v in the histogram with labelValues.
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	i := sort.SearchFloat64s(h.buckets, v)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	hist, ok := h.values[key]
+	if !ok {
+		hist = &histogram{
+			labelValues: append([]string(nil), labelValues...),
+			counts:      make([]uint64, len(h.buckets)),
+		}
+		h.values[key] = hist
+	}
+	if i < len(h.buckets) {
+		hist.counts[i]++
+	}
+	hist.count++
+	hist.sum += v
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	hists := make([]histogram, 0, len(h.values))
+	for _, hist := range h.values {
+		copied := *hist
+		copied.counts = append([]uint64(nil), hist.counts...)
+		hists = append(hists, copied)
+	}
+	h.mu.Unlock()
+
+	sort.Slice(hists, func(i, j int) bool {
+		return lessLabels(hists[i].labelValues, hists[j].labelValues)
+	})
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, escapeHelp(h.help), h.name)
+	bucketLabels := append(append([]string(nil), h.labels...), "le")
+	for _, hist := range hists {
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += hist.counts[i]
+			writeSample(w, h.name+"_bucket", bucketLabels, withLabel(hist.labelValues, formatFloat(upper)), float64(cumulative))
+		}
+		writeSample(w, h.name+"_bucket", bucketLabels, withLabel(hist.labelValues, "+Inf"), float64(hist.count))
+		writeSample(w, h.name+"_sum", h.labels, hist.labelValues, hist.sum)
+		writeSample(w, h.name+"_count", h.labels, hist.labelValues, float64(hist.count))
+	}
+}
+
+// funcFamily computes its samples at scrape time.
+type funcFamily struct {
+	name, help, typ string
+	labels          []string
+	collect         func() []Sample
+}
+
+// NewGaugeFunc registers a gauge whose value is read from fn at scrape time.
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) {
+	r.NewFunc(name, help, "gauge", nil, func() []Sample {
+		return []Sample{{Value: fn()}}
+	})
+}
+
+// NewFunc registers a family of type typ ("counter" or "gauge") whose
+// samples are produced by collect at scrape time. Use it to expose state
+// that is already counted elsewhere.
+func (r *Registry) NewFunc(name, help, typ string, labels []string, collect func() []Sample) {
+	r.register(&funcFamily{name: name, help: help, typ: typ, labels: labels, collect: collect})
+}
+
+func (f *funcFamily) write(w io.Writer) {
+	writeFamily(w, f.name, f.help, f.typ, f.labels, f.collect())
+}
+
+func writeFamily(w io.Writer, name, help, typ string, labels []string, samples []Sample) {
+	sort.Slice(samples, func(i, j int) bool {
+		return lessLabels(samples[i].LabelValues, samples[j].LabelValues)
+	})
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, escapeHelp(help), name, typ)
+	for _, s := range samples {
+		writeSample(w, name, labels, s.LabelValues, s.Value)
+	}
+}
+
+func writeSample(w io.Writer, name string, labels, values []string, v float64) {
+	io.WriteString(w, name)
+	if len(labels) > 0 {
+		io.WriteString(w, "{")
+		for i, label := range labels {
+			if i > 0 {
+				io.WriteString(w, ",")
+			}
+			value := ""
+			if i < len(values) {
+				value = values[i]
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", label, escapeLabel(value))
+		}
+		io.WriteString(w, "}")
+	}
+	fmt.Fprintf(w, " %s\n", formatFloat(v))
+}
+
+// withLabel returns a copy of values with v appended.
+func withLabel(values []string, v string) []string {
+	return append(append(make([]string, 0, len(values)+1), values...), v)
+}
+
+func lessLabels(a, b []string) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return len(a) < len(b)
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
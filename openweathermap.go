@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"weather-bff/config"
+)
+
+// OpenWeatherMap is a WeatherProvider backed by api.openweathermap.org.
+type OpenWeatherMap struct {
+	baseURL string
+	units   string
+	client  *http.Client
+}
+
+// NewOpenWeatherMap returns an OpenWeatherMap provider for upstream that
+// requests units unless told otherwise. Requests are issued through client,
+// whose transport adds the API key.
+func NewOpenWeatherMap(upstream config.Upstream, units string, client *http.Client) *OpenWeatherMap {
+	return &OpenWeatherMap{
+		baseURL: upstream.BaseURL,
+		units:   units,
+		client:  client,
+	}
+}
+
+// Payloads as returned by OpenWeatherMap. These never leave this file.
+type owmCoord struct {
+	Lon float64 `json:"lon"`
+	Lat float64 `json:"lat"`
+}
+
+type owmWeather struct {
+	ID          int    `json:"id"`
+	Main        string `json:"main"`
+	Description string `json:"description"`
+	Icon        string `json:"icon"`
+}
+
+type owmMain struct {
+	Temp     float64 `json:"temp"`
+	TempMin  float64 `json:"temp_min"`
+	TempMax  float64 `json:"temp_max"`
+	Pressure float64 `json:"pressure"`
+	Humidity int     `json:"humidity"`
+}
+
+// owmPrecipitation is the rain or snow volume in mm. Current weather reports
+// the last hour, forecast entries the 3 hours they cover.
+type owmPrecipitation struct {
+	OneHour   float64 `json:"1h"`
+	ThreeHour float64 `json:"3h"`
+}
+
+type owmCurrent struct {
+	Coord   owmCoord          `json:"coord"`
+	Weather []owmWeather      `json:"weather"`
+	Main    owmMain           `json:"main"`
+	Rain    *owmPrecipitation `json:"rain"`
+	Snow    *owmPrecipitation `json:"snow"`
+	Pop     float64           `json:"pop"`
+	Dt      int               `json:"dt"`
+	ID      int               `json:"id"`
+	Name    string            `json:"name"`
+	Cod     int               `json:"cod"`
+}
+
+type owmForecast struct {
+	List []owmCurrent `json:"list"`
+	City struct {
+		Timezone int `json:"timezone"`
+	} `json:"city"`
+}
+
+type owmUVI struct {
+	Lat   float64 `json:"lat"`
+	Lon   float64 `json:"lon"`
+	Value float64 `json:"value"`
+}
+
+// Name implements WeatherProvider.
+func (o *OpenWeatherMap) Name() string {
+	return "openweathermap"
+}
+
+// CurrentWeather implements WeatherProvider.
+func (o *OpenWeatherMap) CurrentWeather(ctx context.Context, loc Location, opts RequestOptions) (CurrentWeatherData, error) {
+	var payload owmCurrent
+
+	url := fmt.Sprintf("%s/weather?%s%s", o.baseURL, locationParams(loc), o.renderParams(opts))
+	if err := o.get(ctx, "weather", loc.Key(), url, &payload); err != nil {
+		return CurrentWeatherData{}, err
+	}
+
+	return payload.toCurrentWeatherData(), nil
+}
+
+// Forecast implements WeatherProvider.
+func (o *OpenWeatherMap) Forecast(ctx context.Context, loc Location, opts RequestOptions) (WeatherForecast, error) {
+	var payload owmForecast
+
+	url := fmt.Sprintf("%s/forecast?%s%s", o.baseURL, locationParams(loc), o.renderParams(opts))
+	if err := o.get(ctx, "forecast", loc.Key(), url, &payload); err != nil {
+		return WeatherForecast{}, err
+	}
+
+	forecast := WeatherForecast{
+		List:           make([]CurrentWeatherData, 0, len(payload.List)),
+		TimezoneOffset: payload.City.Timezone,
+	}
+	for _, entry := range payload.List {
+		forecast.List = append(forecast.List, entry.toCurrentWeatherData())
+	}
+	return forecast, nil
+}
+
+// UVIndex implements WeatherProvider.
+func (o *OpenWeatherMap) UVIndex(ctx context.Context, lat float64, long float64) (UVIndex, error) {
+	var payload owmUVI
+
+	url := fmt.Sprintf("%s/uvi?lat=%f&lon=%f", o.baseURL, lat, long)
+	if err := o.get(ctx, "uvi", fmt.Sprintf("%.4f,%.4f", lat, long), url, &payload); err != nil {
+		return UVIndex{}, err
+	}
+
+	return UVIndex{Value: payload.Value}, nil
+}
+
+// locationParams returns the query parameters selecting loc.
+func locationParams(loc Location) string {
+	switch loc.Kind {
+	case LocationCoordinates:
+		return fmt.Sprintf("lat=%f&lon=%f", loc.Coordinates.Latitude, loc.Coordinates.Longitude)
+	case LocationCity:
+		q := loc.City
+		if loc.Country != "" {
+			q += "," + loc.Country
+		}
+		return "q=" + url.QueryEscape(q)
+	}
+	return "zip=" + url.QueryEscape(loc.Zip+","+loc.Country)
+}
+
+// renderParams returns the units and lang query parameters for opts, falling
+// back to the provider's default units.
+func (o *OpenWeatherMap) renderParams(opts RequestOptions) string {
+	units := opts.Units
+	if units == "" {
+		units = o.units
+	}
+
+	params := "&units=" + units
+	if opts.Lang != "" {
+		params += "&lang=" + opts.Lang
+	}
+	return params
+}
+
+// get fetches url from endpoint and decodes the JSON body into v. location
+// identifies what is being fetched in logs. Non-200 responses are reported as
+// errors rather than decoded, since OpenWeatherMap error bodies have a
+// different shape (and a string "cod").
+// With no key left in budget, get fails with quota.ErrExhausted, wrapped in
+// a *url.Error, without calling the upstream.
+func (o *OpenWeatherMap) get(ctx context.Context, endpoint, location, url string, v interface{}) (err error) {
+	call := startUpstreamCall(ctx, o.Name(), endpoint, location, url)
+	defer call.end(&err)
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := o.client.Do(req.WithContext(call.ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrLocationNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Message string `json:"message"`
+		}
+		json.Unmarshal(body, &apiErr)
+		return &UpstreamStatusError{Upstream: o.Name(), StatusCode: resp.StatusCode, Message: apiErr.Message}
+	}
+
+	return json.Unmarshal(body, v)
+}
+
+func (c owmCurrent) toCurrentWeatherData() CurrentWeatherData {
+	data := CurrentWeatherData{
+		GeoPos: Coordinates{Longitude: c.Coord.Lon, Latitude: c.Coord.Lat},
+		Main: Main{
+			Temp:     c.Main.Temp,
+			TempMin:  c.Main.TempMin,
+			TempMax:  c.Main.TempMax,
+			Pressure: c.Main.Pressure,
+			Humidity: c.Main.Humidity,
+		},
+		Dt:   c.Dt,
+		ID:   c.ID,
+		Name: c.Name,
+		Cod:  c.Cod,
+
+		Precipitation:       c.Rain.volume() + c.Snow.volume(),
+		PrecipitationChance: c.Pop,
+	}
+
+	for _, w := range c.Weather {
+		data.Weather = append(data.Weather, Weather{
+			ID:          w.ID,
+			Main:        w.Main,
+			Description: w.Description,
+			Icon:        w.Icon,
+			Condition:   owmCondition(w.ID),
+			IconURL:     owmIconURL(w.Icon),
+		})
+	}
+	return data
+}
+
+func (p *owmPrecipitation) volume() float64 {
+	if p == nil {
+		return 0
+	}
+	if p.ThreeHour > 0 {
+		return p.ThreeHour
+	}
+	return p.OneHour
+}
+
+// owmCondition maps an OpenWeatherMap condition code onto a Condition, see
+// https://openweathermap.org/weather-conditions.
+func owmCondition(id int) Condition {
+	switch {
+	case id >= 200 && id < 300:
+		return ConditionThunderstorm
+	case id >= 300 && id < 400:
+		return ConditionDrizzle
+	case id >= 500 && id < 600:
+		return ConditionRain
+	case id >= 600 && id < 700:
+		return ConditionSnow
+	case id >= 700 && id < 800:
+		return ConditionFog
+	case id == 800:
+		return ConditionClear
+	case id == 801 || id == 802:
+		return ConditionPartlyCloudy
+	case id == 803 || id == 804:
+		return ConditionCloudy
+	}
+	return ConditionUnknown
+}
+
+func owmIconURL(icon string) string {
+	if icon == "" {
+		return ""
+	}
+	return "https://openweathermap.org/img/wn/" + icon + "@2x.png"
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"weather-bff/config"
+	"weather-bff/logging"
+	"weather-bff/quota"
+)
+
+// popularLocations counts requests per location for the prefetcher.
+var popularLocations = newPopularity(popularityHalfLife, popularityMaxTracked)
+
+// Request counts decay with popularityHalfLife, so the ranking follows recent
+// traffic. At most popularityMaxTracked locations are tracked; the least
+// popular are dropped beyond that.
+const (
+	popularityHalfLife   = time.Hour
+	popularityMaxTracked = 10000
+)
+
+// prefetchSections are the sections the prefetcher can warm. Facts aren't
+// cached.
+var prefetchSections = []string{sectionCurrent, sectionForecast, sectionUV}
+
+// popularity ranks locations, with the rendering options and sections they
+// are requested with, by how often they were requested lately.
+type popularity struct {
+	halfLife   time.Duration
+	maxTracked int
+
+	mu      sync.Mutex
+	targets map[string]*prefetchTarget
+}
+
+// prefetchTarget is a location requested with the same options.
+type prefetchTarget struct {
+	loc      Location
+	opts     RequestOptions
+	sections map[string]bool
+
+	score   float64
+	updated time.Time
+}
+
+// PopularLocation describes a prefetchTarget on /debug/prefetch. Only the
+// area of the location is shown, since the list reveals where people are.
+type PopularLocation struct {
+	Area     string   `json:"area"`
+	Units    string   `json:"units"`
+	Lang     string   `json:"lang,omitempty"`
+	Sections []string `json:"sections"`
+	Score    float64  `json:"score"`
+}
+
+func newPopularity(halfLife time.Duration, maxTracked int) *popularity {
+	return &popularity{
+		halfLife:   halfLife,
+		maxTracked: maxTracked,
+		targets:    make(map[string]*prefetchTarget),
+	}
+}
+
+// record counts a request for sections of loc. Requests for nothing the
+// prefetcher can warm aren't counted.
+func (p *popularity) record(loc Location, opts RequestOptions, sections map[string]bool) {
+	var wanted []string
+	for _, section := range prefetchSections {
+		//The daily summaries are built from the forecast
+		if sections[section] || section == sectionForecast && sections[sectionDaily] {
+			wanted = append(wanted, section)
+		}
+	}
+	if len(wanted) == 0 {
+		return
+	}
+
+	now := time.Now()
+	key := cacheLocationKey(loc, opts)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	t, ok := p.targets[key]
+	if !ok {
+		t = &prefetchTarget{loc: loc, opts: opts, sections: make(map[string]bool), updated: now}
+		p.targets[key] = t
+	}
+	t.decay(now, p.halfLife)
+	t.score++
+	for _, section := range wanted {
+		t.sections[section] = true
+	}
+
+	if len(p.targets) > p.maxTracked {
+		p.pruneLocked(now)
+	}
+}
+
+// top returns the n most popular targets, most popular first.
+func (p *popularity) top(n int) []prefetchTarget {
+	now := time.Now()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ranked := p.rankLocked(now)
+	if len(ranked) > n {
+		ranked = ranked[:n]
+	}
+	top := make([]prefetchTarget, 0, len(ranked))
+	for _, t := range ranked {
+		//record keeps adding sections
+		copied := *t
+		copied.sections = make(map[string]bool, len(t.sections))
+		for section := range t.sections {
+			copied.sections[section] = true
+		}
+		top = append(top, copied)
+	}
+	return top
+}
+
+// forget stops tracking a location, e.g. because it doesn't exist.
+func (p *popularity) forget(loc Location, opts RequestOptions) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.targets, cacheLocationKey(loc, opts))
+}
+
+// rankLocked decays every score to now and sorts the targets by it.
+func (p *popularity) rankLocked(now time.Time) []*prefetchTarget {
+	ranked := make([]*prefetchTarget, 0, len(p.targets))
+	for _, t := range p.targets {
+		t.decay(now, p.halfLife)
+		ranked = append(ranked, t)
+	}
+	sort.Slice(ranked, func(i, j int) bool { return ranked[i].score > ranked[j].score })
+	return ranked
+}
+
+// pruneLocked drops the least popular targets beyond maxTracked, and a few
+// more so it doesn't run on every request.
+func (p *popularity) pruneLocked(now time.Time) {
+	ranked := p.rankLocked(now)
+	keep := p.maxTracked * 9 / 10
+	for _, t := range ranked[keep:] {
+		delete(p.targets, cacheLocationKey(t.loc, t.opts))
+	}
+}
+
+func (t *prefetchTarget) decay(now time.Time, halfLife time.Duration) {
+	elapsed := now.Sub(t.updated)
+	t.score *= math.Pow(0.5, elapsed.Seconds()/halfLife.Seconds())
+	t.updated = now
+}
+
+func (t prefetchTarget) describe() PopularLocation {
+	desc := PopularLocation{
+		Area:  coarseArea(t.loc),
+		Units: t.opts.Units,
+		Lang:  t.opts.Lang,
+		Score: math.Round(t.score*100) / 100,
+	}
+	for _, section := range prefetchSections {
+		if t.sections[section] {
+			desc.Sections = append(desc.Sections, section)
+		}
+	}
+	return desc
+}
+
+// coarseArea names the area around loc: the grid cell of its coordinates to
+// one decimal, about 11km, or the country of a city or zip code.
+func coarseArea(loc Location) string {
+	if loc.Kind == LocationCoordinates {
+		return fmt.Sprintf("coord=%.1f,%.1f", loc.Coordinates.Latitude, loc.Coordinates.Longitude)
+	}
+	if loc.Country == "" {
+		return loc.Kind
+	}
+	return loc.Kind + " in " + loc.Country
+}
+
+// cacheLocationKey identifies a location and the options that change what is
+// cached for it.
+func cacheLocationKey(loc Location, opts RequestOptions) string {
+	return loc.Key() + "|" + opts.Units + "|" + opts.Lang
+}
+
+// prefetcher keeps the most popular locations warm: every interval it
+// refreshes their cache entries that would expire before the next round.
+// It only spends up to half the OpenWeatherMap quota left at the start of a
+// round, so live traffic is never starved of calls.
+type prefetcher struct {
+	provider *CachingProvider
+	quota    *quota.Manager
+	popular  *popularity
+	cfg      config.Prefetch
+	// timeout bounds the upstream calls for one location.
+	timeout time.Duration
+}
+
+// run prefetches every interval until ctx is done.
+func (p *prefetcher) run(ctx context.Context) {
+	ticker := time.NewTicker(p.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.round(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (p *prefetcher) round(ctx context.Context) {
+	logger := logging.Default().With("component", "prefetch")
+	ctx = logging.NewContext(ctx, logger)
+
+	//Entries expiring before the next round has finished are due now
+	ahead := p.cfg.Interval + p.timeout
+
+	//Reading the quota costs a counter lookup per key and window, so it is
+	//read once and the round counts its own calls against it
+	start := p.quota.Status(ctx)
+	minuteAllowance, dayAllowance := allowance(start.RemainingMinute), allowance(start.RemainingDay)
+
+	targets := p.popular.top(p.cfg.Locations)
+	refreshed, calls := 0, 0
+	for i, t := range targets {
+		if ctx.Err() != nil {
+			return
+		}
+		if spent(calls, minuteAllowance) || spent(calls, dayAllowance) {
+			prefetchedLocations.Add(float64(len(targets)-i), "skipped_quota")
+			logger.Info("prefetch stopped to save quota", "done", i, "skipped", len(targets)-i, "calls", calls,
+				"remaining_minute", start.RemainingMinute, "remaining_day", start.RemainingDay)
+			break
+		}
+
+		n, err := p.prefetch(ctx, t, ahead)
+		calls += n
+		switch {
+		case err == ErrLocationNotFound:
+			p.popular.forget(t.loc, t.opts)
+			prefetchedLocations.Inc("failed")
+		case err != nil:
+			prefetchedLocations.Inc("failed")
+		case n > 0:
+			refreshed++
+			prefetchedLocations.Inc("refreshed")
+		default:
+			prefetchedLocations.Inc("warm")
+		}
+	}
+	logger.Debug("prefetch round", "locations", len(targets), "refreshed", refreshed, "calls", calls)
+}
+
+func (p *prefetcher) prefetch(ctx context.Context, t prefetchTarget, ahead time.Duration) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+	return p.provider.Prefetch(ctx, t.loc, t.opts, t.sections, ahead)
+}
+
+// allowance is how many of the remaining calls a round may spend: half,
+// rounded up. Negative values mean the quota has no cap.
+func allowance(remaining int) int {
+	if remaining < 0 {
+		return remaining
+	}
+	return remaining - remaining/2
+}
+
+// spent reports whether calls have used up allowance.
+func spent(calls, allowance int) bool {
+	return allowance >= 0 && calls >= allowance
+}
+
+// recordSections counts a request for sections of loc towards its popularity.
+func recordSections(loc Location, opts RequestOptions, sections ...string) {
+	set := make(map[string]bool, len(sections))
+	for _, section := range sections {
+		set[section] = true
+	}
+	popularLocations.record(loc, opts, set)
+}
+
+func prefetchStatsHandler(c *gin.Context) {
+	top := popularLocations.top(cfg.Prefetch.Locations)
+	locations := make([]PopularLocation, 0, len(top))
+	for _, t := range top {
+		locations = append(locations, t.describe())
+	}
+	c.JSON(http.StatusOK, gin.H{"enabled": cfg.Prefetch.Enabled, "locations": locations})
+}
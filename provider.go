@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrLocationNotFound is returned by a WeatherProvider when the upstream does
+// not recognise the requested location.
+var ErrLocationNotFound = errors.New("location not found")
+
+// UpstreamStatusError is returned when an upstream answers with an HTTP status
+// other than the expected 200.
+type UpstreamStatusError struct {
+	Upstream   string
+	StatusCode int
+	Message    string
+}
+
+func (e *UpstreamStatusError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("%s: status %d", e.Upstream, e.StatusCode)
+	}
+	return fmt.Sprintf("%s: status %d: %s", e.Upstream, e.StatusCode, e.Message)
+}
+
+// RequestOptions control how a provider renders its data.
+type RequestOptions struct {
+	// Units is imperial, metric or standard.
+	Units string
+	// Lang is the language for Weather.Description, empty for the
+	// provider's default.
+	Lang string
+}
+
+// WeatherProvider is implemented by each upstream weather backend. A provider
+// is responsible for calling its own API and mapping the payload into the
+// BFF's domain types; callers never see provider specific structs. Every
+// call should be abandoned as soon as its ctx is done.
+type WeatherProvider interface {
+	// Name identifies the provider, e.g. in logs and cache keys.
+	Name() string
+
+	// CurrentWeather returns the current conditions at loc.
+	CurrentWeather(ctx context.Context, loc Location, opts RequestOptions) (CurrentWeatherData, error)
+
+	// Forecast returns the multi-day forecast for loc.
+	Forecast(ctx context.Context, loc Location, opts RequestOptions) (WeatherForecast, error)
+
+	// UVIndex returns the raw UV index for a position. Only Value is
+	// populated; the BFF maps it into display strings and colors itself.
+	UVIndex(ctx context.Context, lat float64, long float64) (UVIndex, error)
+}
@@ -0,0 +1,159 @@
+package quota
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"weather-bff/logging"
+)
+
+// Counter keeps counts that expire, such as calls per key per window. A
+// Counter shared by every process, like Redis, makes them spend one quota
+// between them.
+type Counter interface {
+	// Incr adds n to the count under key, creating it to expire after ttl
+	// if needed, and returns the new count.
+	Incr(ctx context.Context, key string, n int64, ttl time.Duration) (int64, error)
+}
+
+// MemoryCounter is a Counter local to the process.
+type MemoryCounter struct {
+	mu     sync.Mutex
+	counts map[string]memoryCount
+	swept  time.Time
+}
+
+type memoryCount struct {
+	n       int64
+	expires time.Time
+}
+
+// sweepInterval is how often MemoryCounter drops expired counts.
+const sweepInterval = time.Minute
+
+// NewMemoryCounter returns an empty MemoryCounter.
+func NewMemoryCounter() *MemoryCounter {
+	return &MemoryCounter{counts: make(map[string]memoryCount), swept: time.Now()}
+}
+
+// Incr implements Counter.
+func (c *MemoryCounter) Incr(ctx context.Context, key string, n int64, ttl time.Duration) (int64, error) {
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if now.Sub(c.swept) >= sweepInterval {
+		for k, count := range c.counts {
+			if !now.Before(count.expires) {
+				delete(c.counts, k)
+			}
+		}
+		c.swept = now
+	}
+
+	count, ok := c.counts[key]
+	if !ok || !now.Before(count.expires) {
+		count = memoryCount{expires: now.Add(ttl)}
+	}
+	count.n += n
+	c.counts[key] = count
+	return count.n, nil
+}
+
+// CounterStatus says where spend is being counted.
+type CounterStatus struct {
+	// Shared is set if spend is counted across processes.
+	Shared bool `json:"shared"`
+	// Down is set while the shared counter fails and spend is counted in
+	// process memory instead.
+	Down      bool       `json:"down,omitempty"`
+	DownSince *time.Time `json:"downSince,omitempty"`
+	LastError string     `json:"lastError,omitempty"`
+}
+
+// fallbackCounter counts in a shared Counter, falling back to process memory
+// while it fails. The shared counter is tried again after retryInterval.
+type fallbackCounter struct {
+	shared Counter
+	local  *MemoryCounter
+
+	mu        sync.Mutex
+	downSince time.Time
+	retryAt   time.Time
+	lastErr   error
+}
+
+// retryInterval is how long fallbackCounter stays on process memory after
+// the shared counter fails.
+const retryInterval = 10 * time.Second
+
+func newFallbackCounter(shared Counter) *fallbackCounter {
+	return &fallbackCounter{shared: shared, local: NewMemoryCounter()}
+}
+
+// Incr is Counter.Incr without errors: counting locally can't fail.
+func (c *fallbackCounter) Incr(ctx context.Context, key string, n int64, ttl time.Duration) int64 {
+	if c.useShared() {
+		count, err := c.shared.Incr(ctx, key, n, ttl)
+		if err == nil {
+			c.succeeded()
+			return count
+		}
+		if ctx.Err() == nil {
+			c.failed(err)
+		}
+	}
+	count, _ := c.local.Incr(ctx, key, n, ttl)
+	return count
+}
+
+// Status says whether the shared counter is in use.
+func (c *fallbackCounter) Status() CounterStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	status := CounterStatus{Shared: c.shared != nil}
+	if !c.downSince.IsZero() {
+		since := c.downSince
+		status.Down = true
+		status.DownSince = &since
+		status.LastError = c.lastErr.Error()
+	}
+	return status
+}
+
+func (c *fallbackCounter) useShared() bool {
+	if c.shared == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.downSince.IsZero() || !time.Now().Before(c.retryAt)
+}
+
+func (c *fallbackCounter) succeeded() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.downSince.IsZero() {
+		logging.Default().Info("quota counter recovered", "down_ms", time.Since(c.downSince))
+		c.downSince = time.Time{}
+		c.lastErr = nil
+	}
+}
+
+func (c *fallbackCounter) failed(err error) {
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.downSince.IsZero() {
+		logging.Default().Warn("quota counter failed, counting in memory", "error", err)
+		c.downSince = now
+	}
+	c.retryAt = now.Add(retryInterval)
+	c.lastErr = err
+}
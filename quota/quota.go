@@ -0,0 +1,300 @@
+// Package quota budgets calls to an upstream with per-minute and per-day
+// caps across a pool of API keys. Each call takes a key with budget left,
+// rotating through the pool, and calls are refused while a reserve of the
+// quota remains, so the upstream never has to start rejecting us. Spend is
+// counted in a Counter, which can be shared by every process calling the
+// upstream.
+package quota
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrExhausted is returned by Acquire when no key has budget left.
+var ErrExhausted error = exhaustedError{}
+
+type exhaustedError struct{}
+
+func (exhaustedError) Error() string { return "upstream quota exhausted" }
+
+// Unsent tells the upstream package that the request never left, so it
+// neither counts against the upstream's health nor is retried.
+func (exhaustedError) Unsent() bool { return true }
+
+// benchDuration is how long a key the upstream rejected as invalid is left
+// out of rotation.
+const benchDuration = 10 * time.Minute
+
+// Limits are the upstream's caps per key. Zero means no cap.
+type Limits struct {
+	PerMinute int
+	PerDay    int
+	// Reserve is the fraction of each cap left unused, as headroom for our
+	// windows not lining up exactly with the upstream's.
+	Reserve float64
+}
+
+// budget is the usable part of limit.
+func (l Limits) budget(limit int) int {
+	if limit <= 0 {
+		return 0
+	}
+	return int(math.Floor(float64(limit) * (1 - l.Reserve)))
+}
+
+// Manager hands out keys from a pool within their budgets.
+type Manager struct {
+	limits   Limits
+	counters *fallbackCounter
+
+	mu   sync.Mutex
+	keys []*key
+	next int
+}
+
+type key struct {
+	secret string
+	// id names the key in counters without giving it away.
+	id    string
+	total uint64
+
+	benchedUntil time.Time
+	// fullUntil is the end of a window the key was found to have spent, so
+	// it isn't counted again until then.
+	fullUntil time.Time
+}
+
+// KeyStatus is a snapshot of one key's spend, for operators. The key itself
+// is masked.
+type KeyStatus struct {
+	Key          string `json:"key"`
+	MinuteUsed   int    `json:"minuteUsed"`
+	MinuteBudget int    `json:"minuteBudget,omitempty"`
+	DayUsed      int    `json:"dayUsed"`
+	DayBudget    int    `json:"dayBudget,omitempty"`
+	// Total is the calls made with the key by this process.
+	Total        uint64     `json:"total"`
+	BenchedUntil *time.Time `json:"benchedUntil,omitempty"`
+}
+
+// Status is a snapshot of a Manager.
+type Status struct {
+	Keys []KeyStatus `json:"keys"`
+	// RemainingMinute and RemainingDay are the calls left across all usable
+	// keys in the current windows, or -1 if there is no cap.
+	RemainingMinute int `json:"remainingMinute"`
+	RemainingDay    int `json:"remainingDay"`
+	// Counter is where spend is counted, and whether it is reachable.
+	Counter CounterStatus `json:"counter"`
+}
+
+// NewManager returns a Manager for the keys in pool. Spend is counted in
+// shared, if not nil, and otherwise, or while shared fails, in process
+// memory.
+func NewManager(pool []string, limits Limits, shared Counter) *Manager {
+	m := &Manager{limits: limits, counters: newFallbackCounter(shared)}
+	for _, secret := range pool {
+		sum := sha256.Sum256([]byte(secret))
+		m.keys = append(m.keys, &key{secret: secret, id: hex.EncodeToString(sum[:6])})
+	}
+	return m
+}
+
+// Acquire spends one call from the next key in rotation with budget left and
+// returns it.
+func (m *Manager) Acquire(ctx context.Context) (string, error) {
+	now := time.Now()
+	for _, k := range m.candidates(now) {
+		if !m.spend(ctx, k, now) {
+			continue
+		}
+
+		m.mu.Lock()
+		k.total++
+		for i := range m.keys {
+			if m.keys[i] == k {
+				m.next = i + 1
+			}
+		}
+		m.mu.Unlock()
+		return k.secret, nil
+	}
+	return "", ErrExhausted
+}
+
+// candidates returns the keys that may have budget left, in rotation order.
+func (m *Manager) candidates(now time.Time) []*key {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var keys []*key
+	for i := range m.keys {
+		k := m.keys[(m.next+i)%len(m.keys)]
+		if now.Before(k.benchedUntil) || now.Before(k.fullUntil) {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// spend counts a call against k's windows, reporting whether both had
+// budget for it. A refused call is taken back from every window it was
+// counted in, and a key found out of budget is skipped until its window ends.
+func (m *Manager) spend(ctx context.Context, k *key, now time.Time) bool {
+	var counted []window
+	for _, w := range m.windows(now) {
+		if w.budget == 0 {
+			continue
+		}
+		used := m.counters.Incr(ctx, k.counterKey(w), 1, w.ttl(now))
+		counted = append(counted, w)
+		if used > int64(w.budget) {
+			for _, c := range counted {
+				m.counters.Incr(ctx, k.counterKey(c), -1, c.ttl(now))
+			}
+			m.mu.Lock()
+			if w.end.After(k.fullUntil) {
+				k.fullUntil = w.end
+			}
+			m.mu.Unlock()
+			return false
+		}
+	}
+	return true
+}
+
+// Report tells m how the upstream answered a call made with secret. Rate
+// limit responses mean our accounting is off, so the key's minute is treated
+// as spent; rejected keys are benched for a while.
+func (m *Manager) Report(ctx context.Context, secret string, statusCode int) {
+	now := time.Now()
+	for _, k := range m.keys {
+		if k.secret != secret {
+			continue
+		}
+		switch statusCode {
+		case http.StatusTooManyRequests:
+			minute := m.windows(now)[0]
+			if minute.budget > 0 {
+				m.counters.Incr(ctx, k.counterKey(minute), int64(minute.budget), minute.ttl(now))
+			}
+			m.mu.Lock()
+			k.fullUntil = minute.end
+			m.mu.Unlock()
+		case http.StatusUnauthorized, http.StatusForbidden:
+			m.mu.Lock()
+			k.benchedUntil = now.Add(benchDuration)
+			m.mu.Unlock()
+		}
+	}
+}
+
+// Status returns a snapshot of every key's spend.
+func (m *Manager) Status(ctx context.Context) Status {
+	now := time.Now()
+	windows := m.windows(now)
+	minute, day := windows[0], windows[1]
+
+	status := Status{Keys: make([]KeyStatus, 0, len(m.keys))}
+	if minute.budget == 0 {
+		status.RemainingMinute = -1
+	}
+	if day.budget == 0 {
+		status.RemainingDay = -1
+	}
+
+	for _, k := range m.keys {
+		minuteUsed := m.used(ctx, k, minute, now)
+		dayUsed := m.used(ctx, k, day, now)
+
+		m.mu.Lock()
+		ks := KeyStatus{
+			Key:          mask(k.secret),
+			MinuteUsed:   minuteUsed,
+			MinuteBudget: minute.budget,
+			DayUsed:      dayUsed,
+			DayBudget:    day.budget,
+			Total:        k.total,
+		}
+		if now.Before(k.benchedUntil) {
+			until := k.benchedUntil
+			ks.BenchedUntil = &until
+		}
+		m.mu.Unlock()
+		status.Keys = append(status.Keys, ks)
+
+		if ks.BenchedUntil != nil {
+			continue
+		}
+		if minute.budget > 0 {
+			status.RemainingMinute += remaining(minute.budget, minuteUsed)
+		}
+		if day.budget > 0 {
+			status.RemainingDay += remaining(day.budget, dayUsed)
+		}
+	}
+	status.Counter = m.counters.Status()
+	return status
+}
+
+// used returns how much of w's budget k has spent. Uncapped windows aren't
+// counted.
+func (m *Manager) used(ctx context.Context, k *key, w window, now time.Time) int {
+	if w.budget == 0 {
+		return 0
+	}
+	//Adding nothing reads the count
+	return int(m.counters.Incr(ctx, k.counterKey(w), 0, w.ttl(now)))
+}
+
+// window is one of the periods a cap applies to.
+type window struct {
+	name   string
+	start  time.Time
+	end    time.Time
+	budget int
+}
+
+// windows returns the minute and the day now falls in. Days are UTC, like
+// OpenWeatherMap's.
+func (m *Manager) windows(now time.Time) [2]window {
+	minute := now.Truncate(time.Minute)
+	day := now.UTC().Truncate(24 * time.Hour)
+	return [2]window{
+		{name: "m", start: minute, end: minute.Add(time.Minute), budget: m.limits.budget(m.limits.PerMinute)},
+		{name: "d", start: day, end: day.Add(24 * time.Hour), budget: m.limits.budget(m.limits.PerDay)},
+	}
+}
+
+// ttl keeps a window's count a little past its end, so processes with
+// slightly different clocks still agree on it.
+func (w window) ttl(now time.Time) time.Duration {
+	return w.end.Sub(now) + time.Minute
+}
+
+// counterKey is where k's spend in w is counted.
+func (k *key) counterKey(w window) string {
+	return "quota:" + k.id + ":" + w.name + ":" + w.start.UTC().Format("20060102T1504")
+}
+
+func remaining(budget, used int) int {
+	if used >= budget {
+		return 0
+	}
+	return budget - used
+}
+
+// mask keeps just enough of a key to tell keys apart.
+func mask(secret string) string {
+	if len(secret) <= 4 {
+		return "****"
+	}
+	return "****" + secret[len(secret)-4:]
+}
@@ -0,0 +1,133 @@
+package quota
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// midday keeps the test's minutes inside one UTC day.
+func midday() time.Time {
+	return time.Now().UTC().Truncate(24 * time.Hour).Add(12 * time.Hour)
+}
+
+func TestMinuteCapDoesNotSpendDay(t *testing.T) {
+	m := NewManager([]string{"key-one"}, Limits{PerMinute: 2, PerDay: 10}, nil)
+	ctx := context.Background()
+	k := m.keys[0]
+	now := midday()
+	minute, day := m.windows(now)[0], m.windows(now)[1]
+
+	for i := 0; i < 2; i++ {
+		if !m.spend(ctx, k, now) {
+			t.Fatalf("call %d refused within the minute's budget", i+1)
+		}
+	}
+	if m.spend(ctx, k, now) {
+		t.Fatal("call past the minute's budget was allowed")
+	}
+	if used := m.used(ctx, k, minute, now); used != 2 {
+		t.Errorf("minute used = %d after a refusal, want 2", used)
+	}
+	if used := m.used(ctx, k, day, now); used != 2 {
+		t.Errorf("day used = %d after a refusal, want 2", used)
+	}
+	if !k.fullUntil.Equal(minute.end) {
+		t.Errorf("key skipped until %v, want the end of the minute %v", k.fullUntil, minute.end)
+	}
+
+	//The next minute has budget again, and spends from the same day
+	next := now.Add(time.Minute)
+	if len(m.candidates(next)) != 1 || !m.spend(ctx, k, next) {
+		t.Fatal("call in the next minute was refused")
+	}
+	if used := m.used(ctx, k, day, next); used != 3 {
+		t.Errorf("day used = %d, want 3", used)
+	}
+}
+
+func TestDayCapDoesNotSpendMinute(t *testing.T) {
+	m := NewManager([]string{"key-one"}, Limits{PerMinute: 5, PerDay: 3}, nil)
+	ctx := context.Background()
+	k := m.keys[0]
+	now := midday()
+	minute, day := m.windows(now)[0], m.windows(now)[1]
+
+	for i := 0; i < 3; i++ {
+		if !m.spend(ctx, k, now) {
+			t.Fatalf("call %d refused within the day's budget", i+1)
+		}
+	}
+	if m.spend(ctx, k, now) {
+		t.Fatal("call past the day's budget was allowed")
+	}
+	if used := m.used(ctx, k, minute, now); used != 3 {
+		t.Errorf("minute used = %d after a refusal, want 3", used)
+	}
+	if used := m.used(ctx, k, day, now); used != 3 {
+		t.Errorf("day used = %d after a refusal, want 3", used)
+	}
+
+	//The key stays out of rotation for the rest of the day
+	if !k.fullUntil.Equal(day.end) {
+		t.Errorf("key skipped until %v, want the end of the day %v", k.fullUntil, day.end)
+	}
+	if keys := m.candidates(now.Add(time.Hour)); len(keys) != 0 {
+		t.Errorf("%d keys in rotation later that day, want none", len(keys))
+	}
+}
+
+func TestReserveIsLeftUnspent(t *testing.T) {
+	m := NewManager([]string{"key-one"}, Limits{PerDay: 10, Reserve: 0.2}, nil)
+	ctx := context.Background()
+
+	for i := 0; i < 8; i++ {
+		if _, err := m.Acquire(ctx); err != nil {
+			t.Fatalf("call %d: %v", i+1, err)
+		}
+	}
+	if _, err := m.Acquire(ctx); err != ErrExhausted {
+		t.Fatalf("call into the reserve: err = %v, want %v", err, ErrExhausted)
+	}
+	status := m.Status(ctx)
+	if status.RemainingDay != 0 || status.RemainingMinute != -1 {
+		t.Errorf("remaining = %d a day, %d a minute; want 0 and uncapped", status.RemainingDay, status.RemainingMinute)
+	}
+}
+
+func TestAcquireRotatesThroughKeys(t *testing.T) {
+	m := NewManager([]string{"key-one", "key-two"}, Limits{PerDay: 1}, nil)
+	ctx := context.Background()
+
+	first, err := m.Acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := m.Acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second {
+		t.Errorf("both calls used %q, want each key once", first)
+	}
+	if _, err := m.Acquire(ctx); err != ErrExhausted {
+		t.Errorf("third call: err = %v, want %v", err, ErrExhausted)
+	}
+}
+
+func TestRateLimitedKeySpendsItsMinute(t *testing.T) {
+	m := NewManager([]string{"key-one", "key-two"}, Limits{PerMinute: 5}, nil)
+	ctx := context.Background()
+
+	m.Report(ctx, "key-one", http.StatusTooManyRequests)
+	for i := 0; i < 3; i++ {
+		secret, err := m.Acquire(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if secret != "key-two" {
+			t.Fatalf("call %d used %q after it was rate limited", i+1, secret)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package quota
+
+import (
+	"net/http"
+	"net/url"
+)
+
+// Transport is an http.RoundTripper that adds an API key from Manager to
+// every request it sends to Host, as the query parameter Param, and reports
+// back how the upstream answered. Placed under upstream.Transport, it charges
+// each attempt, retries included. With no key left it fails with
+// ErrExhausted, without sending anything. Requests to other hosts pass
+// through untouched.
+type Transport struct {
+	Next    http.RoundTripper
+	Manager *Manager
+	Host    string
+	Param   string
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host != t.Host {
+		return t.Next.RoundTrip(req)
+	}
+
+	ctx := req.Context()
+	key, err := t.Manager.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	//RoundTrippers must not modify the caller's request
+	u := *req.URL
+	param := t.Param + "=" + url.QueryEscape(key)
+	if u.RawQuery == "" {
+		u.RawQuery = param
+	} else {
+		u.RawQuery += "&" + param
+	}
+	req = req.WithContext(ctx)
+	req.URL = &u
+
+	resp, err := t.Next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	t.Manager.Report(ctx, key, resp.StatusCode)
+	return resp, nil
+}
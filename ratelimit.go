@@ -0,0 +1,136 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"weather-bff/auth"
+	"weather-bff/config"
+	"weather-bff/logging"
+	"weather-bff/ratelimit"
+)
+
+// rateLimitMiddleware limits each client to the configured rate per route,
+// answering 429 with a Retry-After once it is exceeded. Every limited
+// response carries X-RateLimit-Limit (the bucket size), X-RateLimit-Remaining
+// and X-RateLimit-Reset (seconds until the bucket is full).
+func rateLimitMiddleware(router *gin.Engine, rl config.RateLimit, store ratelimit.Store) gin.HandlerFunc {
+	routeOf := routeMatcher(router)
+	limits := make(map[string]ratelimit.Limit, len(rl.Routes))
+	for route, l := range rl.Routes {
+		limits[route] = ratelimit.Limit(l)
+	}
+	defaultLimit := ratelimit.Limit(rl.Default)
+
+	return func(c *gin.Context) {
+		route := routeOf(c.Request.URL.Path)
+		limit, ok := limits[route]
+		if !ok {
+			limit = defaultLimit
+		}
+		if limit.Unlimited() {
+			return
+		}
+
+		res, err := store.Take(c.Request.Context(), route+" "+clientKey(c), limit)
+		if err != nil {
+			//Better to serve than to lock everyone out over a store outage
+			logging.FromContext(c.Request.Context()).Warn("rate limit store failed", "error", err)
+			return
+		}
+
+		burst := limit.Burst
+		if burst < 1 {
+			burst = 1
+		}
+		c.Header("X-RateLimit-Limit", strconv.Itoa(burst))
+		c.Header("X-RateLimit-Remaining", strconv.Itoa(res.Remaining))
+		c.Header("X-RateLimit-Reset", ceilSeconds(res.Reset))
+
+		if !res.Allowed {
+			retryAfter := ceilSeconds(res.RetryAfter)
+			c.Header("Retry-After", retryAfter)
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+				"error": "rate limit exceeded, retry in " + retryAfter + "s",
+			})
+		}
+	}
+}
+
+// authFailureLimitMiddleware runs ahead of authentication and throttles IP
+// addresses that keep failing it, answering 429 until their failures drain
+// from the bucket. Only 401s take tokens, so clients sharing an address with
+// a misbehaving one are only held up while it keeps guessing keys.
+func authFailureLimitMiddleware(limit ratelimit.Limit, store ratelimit.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if isPublic(c.Request.URL.Path) || limit.Unlimited() {
+			return
+		}
+
+		ctx := c.Request.Context()
+		key := "auth ip:" + clientIP(c.Request, cfg.TrustedProxies)
+		res, err := store.Peek(ctx, key, limit)
+		if err != nil {
+			logging.FromContext(ctx).Warn("rate limit store failed", "error", err)
+		} else if !res.Allowed {
+			retryAfter := ceilSeconds(res.RetryAfter)
+			c.Header("Retry-After", retryAfter)
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+				"error": "too many failed authentication attempts, retry in " + retryAfter + "s",
+			})
+			return
+		}
+
+		c.Next()
+		if c.Writer.Status() == http.StatusUnauthorized {
+			if _, err := store.Take(ctx, key, limit); err != nil {
+				logging.FromContext(ctx).Warn("rate limit store failed", "error", err)
+			}
+		}
+	}
+}
+
+// clientKey identifies the client a request counts against: its API key if
+// it authenticated with one, its IP address otherwise. Unverified keys are
+// ignored, or anyone could dodge the limit by making keys up.
+func clientKey(c *gin.Context) string {
+	if client, ok := c.Get(clientContextKey); ok {
+		return "client:" + client.(*auth.Client).Label
+	}
+	return "ip:" + clientIP(c.Request, cfg.TrustedProxies)
+}
+
+// clientIP returns the address of the client that connected to our edge,
+// behind trustedProxies proxies. Each appends the address it was connected
+// from to X-Forwarded-For, so the client is that many entries from the end;
+// entries before it come from the client and can be forged. With no trusted
+// proxies, X-Forwarded-For is ignored altogether.
+func clientIP(r *http.Request, trustedProxies int) string {
+	if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" && trustedProxies > 0 {
+		parts := strings.Split(fwd, ",")
+		//Fewer entries than proxies means some proxy didn't add one; the
+		//first is then the furthest address known
+		i := len(parts) - trustedProxies
+		if i < 0 {
+			i = 0
+		}
+		if ip := strings.TrimSpace(parts[i]); ip != "" {
+			return ip
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func ceilSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
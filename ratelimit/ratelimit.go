@@ -0,0 +1,149 @@
+// Package ratelimit implements token bucket rate limiting. Buckets live in a
+// Store, so limits can be enforced per process with MemoryStore or across
+// dynos with a shared store.
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// Limit allows Requests per Per on average, with bursts of up to Burst.
+type Limit struct {
+	Requests int
+	Per      time.Duration
+	Burst    int
+}
+
+// Unlimited reports whether l doesn't limit anything.
+func (l Limit) Unlimited() bool {
+	return l.Requests <= 0 || l.Per <= 0
+}
+
+// rate is the refill rate in tokens per second.
+func (l Limit) rate() float64 {
+	return float64(l.Requests) / l.Per.Seconds()
+}
+
+func (l Limit) burst() float64 {
+	if l.Burst < 1 {
+		return 1
+	}
+	return float64(l.Burst)
+}
+
+// Result is the outcome of taking a token.
+type Result struct {
+	Allowed bool
+	// Remaining is how many more requests the bucket allows right now.
+	Remaining int
+	// RetryAfter is how long until a token is available, if none was.
+	RetryAfter time.Duration
+	// Reset is how long until the bucket is full again.
+	Reset time.Duration
+}
+
+// Store holds buckets by key.
+type Store interface {
+	// Take takes a token from the bucket for key, creating a full one if
+	// needed, and reports whether there was one.
+	Take(ctx context.Context, key string, limit Limit) (Result, error)
+	// Peek reports what Take would, without taking a token.
+	Peek(ctx context.Context, key string, limit Limit) (Result, error)
+}
+
+// MemoryStore is a Store local to the process.
+type MemoryStore struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	// full is when the bucket will be full, after which it can be dropped.
+	full time.Time
+}
+
+// sweepInterval is how often idle buckets are dropped.
+const sweepInterval = time.Minute
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: make(map[string]*bucket), swept: time.Now()}
+}
+
+// Take implements Store.
+func (s *MemoryStore) Take(ctx context.Context, key string, limit Limit) (Result, error) {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.swept) >= sweepInterval {
+		s.sweepLocked(now)
+	}
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: limit.burst(), updated: now}
+		s.buckets[key] = b
+	}
+	return b.take(now, limit), nil
+}
+
+// Peek implements Store.
+func (s *MemoryStore) Peek(ctx context.Context, key string, limit Limit) (Result, error) {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: limit.burst(), updated: now}
+	}
+	peek := *b
+	res := peek.take(now, limit)
+	if res.Allowed {
+		res.Remaining++
+	}
+	return res, nil
+}
+
+// sweepLocked drops buckets that have refilled, since a new full bucket is
+// equivalent.
+func (s *MemoryStore) sweepLocked(now time.Time) {
+	for key, b := range s.buckets {
+		if !now.Before(b.full) {
+			delete(s.buckets, key)
+		}
+	}
+	s.swept = now
+}
+
+func (b *bucket) take(now time.Time, limit Limit) Result {
+	rate, burst := limit.rate(), limit.burst()
+
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.updated).Seconds()*rate)
+	b.updated = now
+
+	res := Result{}
+	if b.tokens >= 1 {
+		b.tokens--
+		res.Allowed = true
+	} else {
+		res.RetryAfter = seconds((1 - b.tokens) / rate)
+	}
+	res.Remaining = int(b.tokens)
+	res.Reset = seconds((burst - b.tokens) / rate)
+	b.full = now.Add(res.Reset)
+	return res
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
@@ -0,0 +1,99 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBurstThenLimited(t *testing.T) {
+	store := NewMemoryStore()
+	ctx := context.Background()
+	limit := Limit{Requests: 60, Per: time.Minute, Burst: 3}
+
+	for i := 0; i < 3; i++ {
+		res, err := store.Take(ctx, "k", limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !res.Allowed || res.Remaining != 2-i {
+			t.Fatalf("request %d = %+v, want allowed with %d remaining", i+1, res, 2-i)
+		}
+	}
+
+	res, _ := store.Take(ctx, "k", limit)
+	if res.Allowed || res.Remaining != 0 {
+		t.Fatalf("request past the burst = %+v, want refused", res)
+	}
+	//One token a second: the next is at most a second away, a full bucket 3
+	if res.RetryAfter <= 0 || res.RetryAfter > time.Second {
+		t.Errorf("RetryAfter = %v, want up to a second", res.RetryAfter)
+	}
+	if res.Reset <= 2*time.Second || res.Reset > 3*time.Second {
+		t.Errorf("Reset = %v, want up to 3s", res.Reset)
+	}
+
+	//Buckets are per key
+	if res, _ := store.Take(ctx, "other", limit); !res.Allowed {
+		t.Errorf("another key was limited: %+v", res)
+	}
+}
+
+func TestRefill(t *testing.T) {
+	store := NewMemoryStore()
+	ctx := context.Background()
+	limit := Limit{Requests: 20, Per: time.Second, Burst: 2}
+
+	store.Take(ctx, "k", limit)
+	store.Take(ctx, "k", limit)
+	if res, _ := store.Take(ctx, "k", limit); res.Allowed {
+		t.Fatalf("empty bucket allowed a request: %+v", res)
+	}
+
+	//20 a second is a token every 50ms
+	time.Sleep(60 * time.Millisecond)
+	if res, _ := store.Take(ctx, "k", limit); !res.Allowed {
+		t.Fatalf("no token after the refill interval: %+v", res)
+	}
+
+	//Refilling stops at the burst
+	time.Sleep(300 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		if res, _ := store.Take(ctx, "k", limit); !res.Allowed {
+			t.Fatalf("request %d after a long wait refused", i+1)
+		}
+	}
+	if res, _ := store.Take(ctx, "k", limit); res.Allowed {
+		t.Error("bucket refilled past its burst")
+	}
+}
+
+func TestZeroBurstAllowsOne(t *testing.T) {
+	store := NewMemoryStore()
+	limit := Limit{Requests: 1, Per: time.Hour}
+
+	if res, _ := store.Take(context.Background(), "k", limit); !res.Allowed {
+		t.Fatalf("first request refused: %+v", res)
+	}
+	if res, _ := store.Take(context.Background(), "k", limit); res.Allowed {
+		t.Fatalf("second request allowed: %+v", res)
+	}
+}
+
+func TestPeekTakesNothing(t *testing.T) {
+	store := NewMemoryStore()
+	ctx := context.Background()
+	limit := Limit{Requests: 1, Per: time.Hour, Burst: 2}
+
+	for i := 0; i < 3; i++ {
+		res, _ := store.Peek(ctx, "k", limit)
+		if !res.Allowed || res.Remaining != 2 {
+			t.Fatalf("Peek %d = %+v, want allowed with the full bucket left", i+1, res)
+		}
+	}
+	store.Take(ctx, "k", limit)
+	store.Take(ctx, "k", limit)
+	if res, _ := store.Peek(ctx, "k", limit); res.Allowed || res.RetryAfter <= 0 {
+		t.Errorf("Peek of an empty bucket = %+v, want refused", res)
+	}
+}
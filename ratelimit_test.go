@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"weather-bff/config"
+	"weather-bff/ratelimit"
+)
+
+func TestClientIP(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		forwardedFor   string
+		trustedProxies int
+		want           string
+	}{
+		{"no proxies", "", 0, "10.0.0.1"},
+		{"header ignored without trusted proxies", "203.0.113.9", 0, "10.0.0.1"},
+		{"one proxy", "203.0.113.9", 1, "203.0.113.9"},
+		{"forged entries before the proxy's", "198.51.100.1, 203.0.113.9", 1, "203.0.113.9"},
+		{"two proxies", "198.51.100.1, 203.0.113.9, 192.0.2.7", 2, "203.0.113.9"},
+		{"fewer entries than proxies", "203.0.113.9", 2, "203.0.113.9"},
+		{"empty entry", "203.0.113.9, ", 1, "10.0.0.1"},
+		{"trusted proxy but no header", "", 1, "10.0.0.1"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/dashboard", nil)
+		r.RemoteAddr = "10.0.0.1:51234"
+		if tc.forwardedFor != "" {
+			r.Header.Set("X-Forwarded-For", tc.forwardedFor)
+		}
+		if got := clientIP(r, tc.trustedProxies); got != tc.want {
+			t.Errorf("%s: clientIP = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestRateLimitMiddlewareHeaders(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	cfg = &config.Config{}
+	router := gin.New()
+	router.Use(rateLimitMiddleware(router, config.RateLimit{
+		Default: config.Limit{Requests: 60, Per: time.Minute, Burst: 5},
+		Routes: map[string]config.Limit{
+			"/dashboard": {Requests: 1, Per: time.Minute, Burst: 2},
+			"/metrics":   {},
+		},
+	}, ratelimit.NewMemoryStore()))
+	for _, path := range []string{"/dashboard", "/current", "/metrics"} {
+		router.GET(path, func(c *gin.Context) { c.String(http.StatusOK, "ok") })
+	}
+
+	get := func(path, remoteAddr string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	for i, want := range []string{"1", "0"} {
+		w := get("/dashboard", "10.0.0.1:1")
+		if w.Code != http.StatusOK {
+			t.Fatalf("request %d: status %d, want 200", i+1, w.Code)
+		}
+		if h := w.Header(); h.Get("X-RateLimit-Limit") != "2" || h.Get("X-RateLimit-Remaining") != want || h.Get("X-RateLimit-Reset") == "" {
+			t.Errorf("request %d: headers %v, want limit 2 and %s remaining", i+1, h, want)
+		}
+	}
+
+	w := get("/dashboard", "10.0.0.1:1")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("request past the burst: status %d, want 429", w.Code)
+	}
+	if retry := w.Header().Get("Retry-After"); retry != "60" {
+		t.Errorf("Retry-After = %q, want 60", retry)
+	}
+	if reset := w.Header().Get("X-RateLimit-Reset"); reset != "120" {
+		t.Errorf("X-RateLimit-Reset = %q, want 120", reset)
+	}
+
+	//Another client, and another route, have buckets of their own
+	if w := get("/dashboard", "10.0.0.2:1"); w.Code != http.StatusOK {
+		t.Errorf("another client: status %d, want 200", w.Code)
+	}
+	if w := get("/current", "10.0.0.1:1"); w.Code != http.StatusOK || w.Header().Get("X-RateLimit-Limit") != "5" {
+		t.Errorf("another route: status %d, headers %v; want the default limit", w.Code, w.Header())
+	}
+	//Unlimited routes carry no headers
+	if w := get("/metrics", "10.0.0.1:1"); w.Code != http.StatusOK || w.Header().Get("X-RateLimit-Limit") != "" {
+		t.Errorf("unlimited route: status %d, headers %v", w.Code, w.Header())
+	}
+}
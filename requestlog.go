@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"weather-bff/logging"
+	"weather-bff/trace"
+)
+
+// requestIDHeader carries the request ID in both directions.
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds caller supplied request IDs, which end up in
+// every log line of the request.
+const maxRequestIDLength = 128
+
+// requestIDMiddleware gives every request an ID, reusing the caller's
+// X-Request-ID if it is sensible, and echoes it in the response. The request's
+// context carries a logger tagged with the ID, route and trace, so everything
+// logged on its behalf can be correlated.
+func requestIDMiddleware(router *gin.Engine) gin.HandlerFunc {
+	routeOf := routeMatcher(router)
+
+	return func(c *gin.Context) {
+		id := c.GetHeader(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		c.Header(requestIDHeader, id)
+
+		ctx := c.Request.Context()
+		logger := logging.Default().With("request_id", id, "route", routeOf(c.Request.URL.Path))
+		if span := trace.FromContext(ctx); span != nil {
+			logger = logger.With("trace_id", span.SpanContext().TraceID)
+		}
+		c.Request = c.Request.WithContext(logging.NewContext(ctx, logger))
+
+		c.Next()
+	}
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range id {
+		if !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || r == '-' || r == '_' || r == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// accessLogMiddleware logs one line per request, replacing gin's text
+// logger. Server errors are logged as errors, everything else as info.
+func accessLogMiddleware(c *gin.Context) {
+	start := time.Now()
+
+	c.Next()
+
+	status := c.Writer.Status()
+	size := c.Writer.Size()
+	if size < 0 {
+		size = 0
+	}
+	fields := []interface{}{
+		"method", c.Request.Method,
+		"path", c.Request.URL.Path,
+		"query", logging.Redact(c.Request.URL.RawQuery),
+		"status", status,
+		"bytes", size,
+		"duration_ms", time.Since(start),
+		"client_ip", clientIP(c.Request, cfg.TrustedProxies),
+	}
+
+	logger := logging.FromContext(c.Request.Context())
+	if status >= 500 {
+		logger.Error("request", fields...)
+	} else {
+		logger.Info("request", fields...)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+)
+
+// The single-section endpoints below share the dashboard's location parsing,
+// cache and error format, but only call the upstreams their section needs.
+// A successful response carries the data under the section's name; a failed
+// one an errors block exactly like the dashboard's.
+
+func currentHandler(c *gin.Context) {
+	loc, opts, ok := parseDashboardRequest(c)
+	if !ok {
+		return
+	}
+
+	recordSections(loc, opts, sectionCurrent)
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+
+	ch := make(chan weatherResult, 1)
+	go GetWeather(ctx, weatherProvider, ch, nil, loc, opts)
+
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			respondSectionError(c, sectionCurrent, newSectionError(r.err))
+			return
+		}
+		noteObserved(ctx, r.data.Dt)
+		respondSection(c, sectionCurrent, r.data, &opts, cacheable)
+	case <-ctx.Done():
+		respondSectionError(c, sectionCurrent, timeoutSectionError)
+	}
+}
+
+func forecastHandler(c *gin.Context) {
+	loc, opts, ok := parseDashboardRequest(c)
+	if !ok {
+		return
+	}
+
+	recordSections(loc, opts, sectionForecast)
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+
+	ch := make(chan forecastResult, 1)
+	go GetForecast(ctx, weatherProvider, ch, loc, opts)
+
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			respondSectionError(c, sectionForecast, newSectionError(r.err))
+			return
+		}
+		respondSection(c, sectionForecast, r.data, &opts, cacheable)
+	case <-ctx.Done():
+		respondSectionError(c, sectionForecast, timeoutSectionError)
+	}
+}
+
+// uvHandler goes straight to the UV index for lat/lon requests. Any other
+// location has to be resolved to coordinates through current weather first,
+// which is usually already cached.
+func uvHandler(c *gin.Context) {
+	loc, opts, ok := parseDashboardRequest(c)
+	if !ok {
+		return
+	}
+
+	recordSections(loc, opts, sectionUV)
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+
+	ch3 := make(chan uvResult, 1)
+	if loc.Kind == LocationCoordinates {
+		go GetUVIndex(ctx, weatherProvider, ch3, loc.Coordinates.Latitude, loc.Coordinates.Longitude)
+	} else {
+		go GetWeather(ctx, weatherProvider, make(chan weatherResult, 1), ch3, loc, opts)
+	}
+
+	select {
+	case r := <-ch3:
+		if r.err != nil {
+			respondSectionError(c, sectionUV, newSectionError(r.err))
+			return
+		}
+		respondSection(c, sectionUV, r.data, nil, cacheable)
+	case <-ctx.Done():
+		respondSectionError(c, sectionUV, timeoutSectionError)
+	}
+}
+
+func factHandler(c *gin.Context) {
+	ctx, cancel := requestContext(c)
+	defer cancel()
+
+	ch2 := make(chan factResult, 1)
+	go GetFact(ctx, ch2)
+
+	select {
+	case r := <-ch2:
+		if r.err != nil {
+			respondSectionError(c, sectionFact, newSectionError(r.err))
+			return
+		}
+		respondSection(c, sectionFact, r.data, nil, uncacheable)
+	case <-ctx.Done():
+		respondSectionError(c, sectionFact, timeoutSectionError)
+	}
+}
+
+// respondSection writes data under the section's name, labeled with the units
+// and language if opts is given, and with the data's freshness if it came
+// from the cache.
+func respondSection(c *gin.Context, section string, data interface{}, opts *RequestOptions, policy cachePolicy) {
+	body := gin.H{section: data}
+	if opts != nil {
+		body["units"] = unitSystems[opts.Units]
+		if opts.Lang != "" {
+			body["lang"] = opts.Lang
+		}
+	}
+	if fresh := freshnessFrom(c.Request.Context()).report(); fresh.AsOf != "" {
+		body["asOf"] = fresh.AsOf
+		if fresh.Stale {
+			body["stale"] = true
+		}
+	}
+	respondCached(c, body, policy)
+}
+
+func respondSectionError(c *gin.Context, section string, e SectionError) {
+	c.JSON(sectionErrorStatus(e), gin.H{"errors": gin.H{section: e}})
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"weather-bff/logging"
+)
+
+// flushTimeout bounds the shutdown hooks once requests have drained. With the
+// default grace period, shutdown finishes well within the 30 seconds Heroku
+// allows after SIGTERM.
+const flushTimeout = 5 * time.Second
+
+// shuttingDown is set once a shutdown signal arrives, so /readyz can take the
+// dyno out of rotation while it drains.
+var shuttingDown int32
+
+func isShuttingDown() bool {
+	return atomic.LoadInt32(&shuttingDown) != 0
+}
+
+type shutdownHook struct {
+	name string
+	fn   func(context.Context) error
+}
+
+// shutdownHooks run in registration order after in-flight requests have
+// drained.
+var shutdownHooks []shutdownHook
+
+// onShutdown registers fn to flush or release something named name before the
+// process exits.
+func onShutdown(name string, fn func(context.Context) error) {
+	shutdownHooks = append(shutdownHooks, shutdownHook{name, fn})
+}
+
+// serve serves handler on addr until SIGTERM or SIGINT, then stops accepting
+// connections, gives in-flight requests the grace period to finish and runs
+// the shutdown hooks. It returns early only if the server fails to start.
+func serve(addr string, handler http.Handler, grace time.Duration) error {
+	logger := logging.Default()
+	srv := &http.Server{Addr: addr, Handler: handler}
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.ListenAndServe()
+	}()
+	logger.Info("listening", "addr", addr)
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGTERM, os.Interrupt)
+
+	select {
+	case err := <-errc:
+		return err
+	case sig := <-sigc:
+		//A second signal kills the process outright
+		signal.Stop(sigc)
+		atomic.StoreInt32(&shuttingDown, 1)
+		logger.Info("shutting down", "signal", sig.String(), "grace_ms", grace)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	err := srv.Shutdown(ctx)
+	cancel()
+	if err != nil {
+		logger.Warn("grace period expired, closing remaining connections", "error", err)
+		srv.Close()
+	} else {
+		logger.Info("in-flight requests drained")
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), flushTimeout)
+	defer cancel()
+	for _, hook := range shutdownHooks {
+		if err := hook.fn(ctx); err != nil {
+			logger.Error("shutdown hook failed", "hook", hook.name, "error", err)
+		}
+	}
+	logger.Info("stopped")
+	return nil
+}
@@ -0,0 +1,402 @@
+// Package trace records spans for inbound requests and the upstream calls
+// they fan out to, propagates them with the W3C traceparent header, and
+// exports finished spans in batches.
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	mathrand "math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"weather-bff/logging"
+)
+
+// TraceID identifies a whole trace.
+type TraceID [16]byte
+
+// SpanID identifies one span within a trace.
+type SpanID [8]byte
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+func (s SpanID) String() string  { return hex.EncodeToString(s[:]) }
+
+// IsValid reports whether t is not all zeros, which the spec forbids.
+func (t TraceID) IsValid() bool { return t != TraceID{} }
+
+// IsValid reports whether s is not all zeros, which the spec forbids.
+func (s SpanID) IsValid() bool { return s != SpanID{} }
+
+// SpanContext is the part of a span that crosses process boundaries.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+// IsValid reports whether sc identifies a span.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+// Traceparent formats sc as a version 00 traceparent header value.
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-" + flags
+}
+
+// ParseTraceparent parses a traceparent header value. Versions other than 00
+// are accepted as long as they start with the version 00 fields, as the spec
+// asks.
+func ParseTraceparent(h string) (SpanContext, bool) {
+	var sc SpanContext
+
+	h = strings.TrimSpace(h)
+	parts := strings.Split(h, "-")
+	if len(parts) < 4 {
+		return sc, false
+	}
+	version, traceID, spanID, flags := parts[0], parts[1], parts[2], parts[3]
+	if len(version) != 2 || version == "ff" || !isLowerHex(version) {
+		return sc, false
+	}
+	if version == "00" && len(parts) != 4 {
+		return sc, false
+	}
+	if len(traceID) != 32 || len(spanID) != 16 || len(flags) != 2 ||
+		!isLowerHex(traceID) || !isLowerHex(spanID) || !isLowerHex(flags) {
+		return sc, false
+	}
+
+	hex.Decode(sc.TraceID[:], []byte(traceID))
+	hex.Decode(sc.SpanID[:], []byte(spanID))
+	var f [1]byte
+	hex.Decode(f[:], []byte(flags))
+	sc.Sampled = f[0]&1 == 1
+
+	return sc, sc.IsValid()
+}
+
+func isLowerHex(s string) bool {
+	for _, r := range s {
+		if !('0' <= r && r <= '9' || 'a' <= r && r <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// SpanKind says what side of a call a span represents.
+type SpanKind int
+
+// Span kinds, numbered as in OTLP.
+const (
+	KindInternal SpanKind = 1
+	KindServer   SpanKind = 2
+	KindClient   SpanKind = 3
+)
+
+// Attribute is a key/value pair attached to a span. Value is a string, bool,
+// int64 or float64.
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// String returns a string attribute.
+func String(key, value string) Attribute { return Attribute{key, value} }
+
+// Int returns an integer attribute.
+func Int(key string, value int64) Attribute { return Attribute{key, value} }
+
+// Bool returns a boolean attribute.
+func Bool(key string, value bool) Attribute { return Attribute{key, value} }
+
+// SpanData is a finished span, as handed to an Exporter.
+type SpanData struct {
+	Name         string
+	Kind         SpanKind
+	SpanContext  SpanContext
+	ParentSpanID SpanID
+	Start, End   time.Time
+	Attributes   []Attribute
+	Error        bool
+	Message      string
+}
+
+// Span is an operation in progress. A nil *Span is valid and records nothing,
+// so callers never need to check whether tracing is on.
+type Span struct {
+	tracer *Tracer
+
+	mu    sync.Mutex
+	data  SpanData
+	ended bool
+}
+
+// SpanContext returns the identity of s.
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.data.SpanContext
+}
+
+// SetAttributes adds attrs to s.
+func (s *Span) SetAttributes(attrs ...Attribute) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Attributes = append(s.data.Attributes, attrs...)
+}
+
+// SetError marks s as failed, described by msg.
+func (s *Span) SetError(msg string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Error = true
+	s.data.Message = msg
+}
+
+// End finishes s and queues it for export if it is sampled. Only the first
+// call has any effect.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	data := s.data
+	s.mu.Unlock()
+
+	if data.SpanContext.Sampled {
+		s.tracer.enqueue(data)
+	}
+}
+
+type spanKey struct{}
+type remoteKey struct{}
+
+// ContextWithSpan returns a copy of ctx carrying s as the current span.
+func ContextWithSpan(ctx context.Context, s *Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, s)
+}
+
+// FromContext returns the current span in ctx, or nil.
+func FromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// ContextWithRemoteParent returns a copy of ctx in which sc, received from
+// another process, is the parent of the next span started.
+func ContextWithRemoteParent(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+// Tracer creates spans and exports them in batches in the background.
+type Tracer struct {
+	exporter Exporter
+
+	queue chan SpanData
+	flush chan chan struct{}
+	done  chan struct{}
+	stop  sync.Once
+
+	mu  sync.Mutex
+	rnd *mathrand.Rand
+}
+
+const (
+	queueSize     = 2048
+	batchSize     = 256
+	flushInterval = 5 * time.Second
+)
+
+// NewTracer returns a Tracer that exports through exporter. A nil exporter
+// still propagates trace context but exports nothing.
+func NewTracer(exporter Exporter) *Tracer {
+	var seed int64
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err == nil {
+		seed = int64(binary.LittleEndian.Uint64(b[:]))
+	} else {
+		seed = time.Now().UnixNano()
+	}
+
+	t := &Tracer{
+		exporter: exporter,
+		queue:    make(chan SpanData, queueSize),
+		flush:    make(chan chan struct{}),
+		done:     make(chan struct{}),
+		rnd:      mathrand.New(mathrand.NewSource(seed)),
+	}
+	if exporter != nil {
+		go t.run()
+	}
+	return t
+}
+
+// Start starts a span named name as a child of the current span in ctx, or of
+// a remote parent, or as the root of a new trace. It returns a context
+// carrying the new span.
+func (t *Tracer) Start(ctx context.Context, name string, kind SpanKind, attrs ...Attribute) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+
+	var parent SpanContext
+	if p := FromContext(ctx); p != nil {
+		parent = p.SpanContext()
+	} else if remote, ok := ctx.Value(remoteKey{}).(SpanContext); ok {
+		parent = remote
+	}
+
+	sc := SpanContext{SpanID: t.newSpanID(), Sampled: true}
+	if parent.IsValid() {
+		sc.TraceID = parent.TraceID
+		sc.Sampled = parent.Sampled
+	} else {
+		sc.TraceID = t.newTraceID()
+	}
+
+	s := &Span{
+		tracer: t,
+		data: SpanData{
+			Name:         name,
+			Kind:         kind,
+			SpanContext:  sc,
+			ParentSpanID: parent.SpanID,
+			Start:        time.Now(),
+			Attributes:   attrs,
+		},
+	}
+	return ContextWithSpan(ctx, s), s
+}
+
+func (t *Tracer) newTraceID() (id TraceID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for !id.IsValid() {
+		t.rnd.Read(id[:])
+	}
+	return id
+}
+
+func (t *Tracer) newSpanID() (id SpanID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for !id.IsValid() {
+		t.rnd.Read(id[:])
+	}
+	return id
+}
+
+// enqueue hands a finished span to the export loop, dropping it if the
+// exporter can't keep up rather than blocking the request.
+func (t *Tracer) enqueue(data SpanData) {
+	if t.exporter == nil {
+		return
+	}
+	select {
+	case <-t.done:
+	case t.queue <- data:
+	default:
+	}
+}
+
+func (t *Tracer) run() {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	var batch []SpanData
+	export := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.exporter.Export(batch); err != nil {
+			logging.Default().Warn("dropped spans", "count", len(batch), "error", err)
+		}
+		batch = nil
+	}
+
+	for {
+		select {
+		case data := <-t.queue:
+			batch = append(batch, data)
+			if len(batch) >= batchSize {
+				export()
+			}
+		case <-ticker.C:
+			export()
+		case flushed := <-t.flush:
+			t.drain(&batch)
+			export()
+			close(flushed)
+		case <-t.done:
+			t.drain(&batch)
+			export()
+			return
+		}
+	}
+}
+
+func (t *Tracer) drain(batch *[]SpanData) {
+	for {
+		select {
+		case data := <-t.queue:
+			*batch = append(*batch, data)
+		default:
+			return
+		}
+	}
+}
+
+// Flush exports every span ended so far, or gives up when ctx is done.
+func (t *Tracer) Flush(ctx context.Context) error {
+	if t == nil || t.exporter == nil {
+		return nil
+	}
+	flushed := make(chan struct{})
+	select {
+	case t.flush <- flushed:
+	case <-t.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-flushed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Shutdown exports every span ended so far and stops the export loop. Spans
+// ended afterwards are dropped.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	if t == nil || t.exporter == nil {
+		return nil
+	}
+	err := t.Flush(ctx)
+	t.stop.Do(func() { close(t.done) })
+	return err
+}
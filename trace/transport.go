@@ -0,0 +1,88 @@
+package trace
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// Transport is an http.RoundTripper that records a client span per call,
+// child of the current span in the request's context, and propagates it to
+// the upstream in the traceparent header. The span ends once the response
+// body is closed, so it covers reading the body and records its size.
+type Transport struct {
+	Next   http.RoundTripper
+	Tracer *Tracer
+	// FormatURL renders the URL recorded on spans, e.g. to redact API keys.
+	// Defaults to the full URL.
+	FormatURL func(*url.URL) string
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	formatURL := t.FormatURL
+	if formatURL == nil {
+		formatURL = (*url.URL).String
+	}
+
+	ctx, span := t.Tracer.Start(req.Context(), req.Method+" "+req.URL.Host+req.URL.Path, KindClient,
+		String("http.method", req.Method),
+		String("http.url", formatURL(req.URL)),
+		String("net.peer.name", req.URL.Host),
+	)
+	if span == nil {
+		return t.Next.RoundTrip(req)
+	}
+
+	//RoundTrippers must not modify the caller's request
+	req = req.WithContext(ctx)
+	req.Header = cloneHeader(req.Header)
+	req.Header.Set("traceparent", span.SpanContext().Traceparent())
+
+	resp, err := t.Next.RoundTrip(req)
+	if err != nil {
+		span.SetError(err.Error())
+		span.End()
+		return nil, err
+	}
+
+	span.SetAttributes(Int("http.status_code", int64(resp.StatusCode)))
+	if resp.StatusCode >= 400 {
+		span.SetError(resp.Status)
+	}
+	resp.Body = &spanBody{ReadCloser: resp.Body, span: span}
+	return resp, nil
+}
+
+func cloneHeader(h http.Header) http.Header {
+	clone := make(http.Header, len(h)+1)
+	for k, v := range h {
+		clone[k] = append([]string(nil), v...)
+	}
+	return clone
+}
+
+// spanBody counts the bytes read from a response body and ends the span when
+// the body is closed.
+type spanBody struct {
+	io.ReadCloser
+	span  *Span
+	bytes int64
+	once  sync.Once
+}
+
+func (b *spanBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.bytes += int64(n)
+	return n, err
+}
+
+func (b *spanBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() {
+		b.span.SetAttributes(Int("http.response_content_length", b.bytes))
+		b.span.End()
+	})
+	return err
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+
+	"weather-bff/config"
+	"weather-bff/trace"
+)
+
+// tracer records a span per inbound request and per upstream call. Spans are
+// only exported if an exporter is configured, but trace context is always
+// propagated.
+var tracer *trace.Tracer
+
+func newTracer(c config.Tracing) *trace.Tracer {
+	switch c.Exporter {
+	case "stdout":
+		return trace.NewTracer(trace.NewStdoutExporter(os.Stdout))
+	case "otlp":
+		return trace.NewTracer(trace.NewOTLPExporter(c.Endpoint, c.ServiceName, nil))
+	}
+	return trace.NewTracer(nil)
+}
+
+// tracingMiddleware starts the server span for every request, continuing the
+// caller's trace if it sent a valid traceparent header. Handlers derive their
+// contexts from the request's, so upstream calls become its children.
+func tracingMiddleware(router *gin.Engine) gin.HandlerFunc {
+	routeOf := routeMatcher(router)
+
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		if parent, ok := trace.ParseTraceparent(c.GetHeader("traceparent")); ok {
+			ctx = trace.ContextWithRemoteParent(ctx, parent)
+		}
+
+		route := routeOf(c.Request.URL.Path)
+		ctx, span := tracer.Start(ctx, c.Request.Method+" "+route, trace.KindServer,
+			trace.String("http.method", c.Request.Method),
+			trace.String("http.route", route),
+			trace.String("http.target", c.Request.URL.Path),
+		)
+		defer span.End()
+		c.Request = c.Request.WithContext(ctx)
+
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttributes(trace.Int("http.status_code", int64(status)))
+		if size := c.Writer.Size(); size >= 0 {
+			span.SetAttributes(trace.Int("http.response_content_length", int64(size)))
+		}
+		if status >= 500 {
+			span.SetError(http.StatusText(status))
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// UnitSystem labels the units the numbers in a response are expressed in, so
+// clients don't have to know each system's conventions.
+type UnitSystem struct {
+	System      string `json:"system"`
+	Temperature string `json:"temperature"`
+	WindSpeed   string `json:"windSpeed"`
+	Pressure    string `json:"pressure"`
+}
+
+var unitSystems = map[string]UnitSystem{
+	"imperial": {System: "imperial", Temperature: "°F", WindSpeed: "mph", Pressure: "hPa"},
+	"metric":   {System: "metric", Temperature: "°C", WindSpeed: "m/s", Pressure: "hPa"},
+	"standard": {System: "standard", Temperature: "K", WindSpeed: "m/s", Pressure: "hPa"},
+}
+
+// langPattern matches the language codes OpenWeatherMap accepts, e.g. "de",
+// "pt_br" or "zh_tw".
+var langPattern = regexp.MustCompile(`^[a-z]{2}(_[a-z]{2})?$`)
+
+// parseRequestOptions validates the units and lang query values, falling back
+// to defaultUnits when units is empty.
+func parseRequestOptions(units, lang, defaultUnits string) (RequestOptions, error) {
+	units = strings.ToLower(units)
+	if units == "" {
+		units = defaultUnits
+	}
+	if _, ok := unitSystems[units]; !ok {
+		return RequestOptions{}, fmt.Errorf("units must be one of imperial, metric, standard")
+	}
+
+	lang = strings.Replace(strings.ToLower(lang), "-", "_", 1)
+	if lang != "" && !langPattern.MatchString(lang) {
+		return RequestOptions{}, fmt.Errorf("lang %q is not a valid language code", lang)
+	}
+
+	return RequestOptions{Units: units, Lang: lang}, nil
+}
@@ -0,0 +1,130 @@
+package upstream
+
+import (
+	"sync"
+	"time"
+)
+
+// Breaker states.
+const (
+	StateClosed   = "closed"
+	StateOpen     = "open"
+	StateHalfOpen = "half_open"
+)
+
+// BreakerStatus is a snapshot of one breaker, for operators.
+type BreakerStatus struct {
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutiveFailures"`
+	Successes           uint64     `json:"successes"`
+	Failures            uint64     `json:"failures"`
+	Rejected            uint64     `json:"rejected"`
+	LastFailure         string     `json:"lastFailure,omitempty"`
+	OpenedAt            *time.Time `json:"openedAt,omitempty"`
+}
+
+// Breaker is a consecutive-failure circuit breaker. After threshold failures
+// in a row it opens and rejects calls for openTimeout, then lets a single
+// probe through: success closes it again, failure re-opens it.
+type Breaker struct {
+	threshold   int
+	openTimeout time.Duration
+
+	mu          sync.Mutex
+	state       string
+	consecutive int
+	openedAt    time.Time
+	probing     bool
+
+	successes   uint64
+	failures    uint64
+	rejected    uint64
+	lastFailure string
+}
+
+// NewBreaker returns a closed Breaker.
+func NewBreaker(threshold int, openTimeout time.Duration) *Breaker {
+	return &Breaker{threshold: threshold, openTimeout: openTimeout, state: StateClosed}
+}
+
+// Allow reports whether a call may proceed. Every allowed call must be
+// followed by exactly one Success, Failure or Release.
+func (b *Breaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case StateOpen:
+		if time.Since(b.openedAt) < b.openTimeout {
+			b.rejected++
+			return false
+		}
+		b.state = StateHalfOpen
+		b.probing = true
+		return true
+	case StateHalfOpen:
+		if b.probing {
+			b.rejected++
+			return false
+		}
+		b.probing = true
+		return true
+	}
+	return true
+}
+
+// Success records a call that reached a healthy upstream.
+func (b *Breaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.successes++
+	b.consecutive = 0
+	b.probing = false
+	b.state = StateClosed
+}
+
+// Failure records a failed call, described by reason.
+func (b *Breaker) Failure(reason string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	b.consecutive++
+	b.lastFailure = reason
+	b.probing = false
+
+	if b.state == StateHalfOpen || b.consecutive >= b.threshold {
+		b.state = StateOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// Release records an allowed call that ended without saying anything about
+// the upstream's health, e.g. because the caller gave up.
+func (b *Breaker) Release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+}
+
+// Status returns a snapshot of b.
+func (b *Breaker) Status() BreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	status := BreakerStatus{
+		State:               b.state,
+		ConsecutiveFailures: b.consecutive,
+		Successes:           b.successes,
+		Failures:            b.failures,
+		Rejected:            b.rejected,
+		LastFailure:         b.lastFailure,
+	}
+	if b.state != StateClosed {
+		openedAt := b.openedAt
+		status.OpenedAt = &openedAt
+	}
+	return status
+}
@@ -0,0 +1,73 @@
+package upstream
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBreakerOpensAfterThreshold(t *testing.T) {
+	b := NewBreaker(3, time.Minute)
+
+	for i := 0; i < 2; i++ {
+		if !b.Allow() {
+			t.Fatalf("call %d rejected below the threshold", i+1)
+		}
+		b.Failure("status 500")
+	}
+	//A success in between starts the count over
+	b.Allow()
+	b.Success()
+	for i := 0; i < 3; i++ {
+		if !b.Allow() {
+			t.Fatalf("call %d rejected below the threshold", i+1)
+		}
+		b.Failure("status 500")
+	}
+
+	if b.Allow() {
+		t.Fatal("breaker allowed a call after threshold failures")
+	}
+	status := b.Status()
+	if status.State != StateOpen || status.ConsecutiveFailures != 3 || status.Rejected != 1 ||
+		status.LastFailure != "status 500" || status.OpenedAt == nil {
+		t.Errorf("Status = %+v, want open after 3 failures with 1 rejected", status)
+	}
+}
+
+func TestBreakerHalfOpen(t *testing.T) {
+	for name, tc := range map[string]struct {
+		probe     func(b *Breaker)
+		wantState string
+		wantAllow bool
+	}{
+		"probe succeeds": {func(b *Breaker) { b.Success() }, StateClosed, true},
+		"probe fails":    {func(b *Breaker) { b.Failure("timeout") }, StateOpen, false},
+		"probe released": {func(b *Breaker) { b.Release() }, StateHalfOpen, true},
+	} {
+		b := NewBreaker(1, 20*time.Millisecond)
+		b.Allow()
+		b.Failure("timeout")
+		if b.Allow() {
+			t.Fatalf("%s: breaker allowed a call while open", name)
+		}
+
+		time.Sleep(20 * time.Millisecond)
+		if !b.Allow() {
+			t.Fatalf("%s: no probe let through after the open timeout", name)
+		}
+		if state := b.Status().State; state != StateHalfOpen {
+			t.Fatalf("%s: state = %s, want half open", name, state)
+		}
+		if b.Allow() {
+			t.Fatalf("%s: a second call allowed while probing", name)
+		}
+
+		tc.probe(b)
+		if state := b.Status().State; state != tc.wantState {
+			t.Errorf("%s: state = %s, want %s", name, state, tc.wantState)
+		}
+		if allowed := b.Allow(); allowed != tc.wantAllow {
+			t.Errorf("%s: next call allowed = %v, want %v", name, allowed, tc.wantAllow)
+		}
+	}
+}
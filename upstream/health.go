@@ -0,0 +1,123 @@
+package upstream
+
+import (
+	"sync"
+	"time"
+)
+
+// maxOutcomes bounds the outcomes kept per upstream, however busy it is.
+const maxOutcomes = 1000
+
+// Health keeps the recent outcomes of calls to each upstream, so readiness
+// checks can tell a healthy upstream from one that keeps failing.
+type Health struct {
+	window time.Duration
+
+	mu        sync.Mutex
+	upstreams map[string]*history
+}
+
+type outcome struct {
+	at      time.Time
+	ok      bool
+	failure string
+}
+
+type history struct {
+	outcomes    []outcome
+	last        outcome
+	lastFailure outcome
+}
+
+// HealthStatus summarizes the recent calls to one upstream.
+type HealthStatus struct {
+	// Samples is the number of calls in the window, Successes how many of
+	// them succeeded.
+	Samples   int `json:"samples"`
+	Successes int `json:"successes"`
+	// SuccessRate is Successes/Samples, or 1 if there were no calls.
+	SuccessRate float64 `json:"successRate"`
+	// LastOK is whether the most recent call succeeded, and LastFailure
+	// describes the most recent failure. Neither is limited to the window,
+	// so an upstream that failed and has not been called since still shows
+	// as failing.
+	LastOK        bool       `json:"lastOk"`
+	LastFailure   string     `json:"lastFailure,omitempty"`
+	LastFailureAt *time.Time `json:"lastFailureAt,omitempty"`
+}
+
+// NewHealth returns a Health that considers outcomes within window.
+func NewHealth(window time.Duration) *Health {
+	return &Health{window: window, upstreams: make(map[string]*history)}
+}
+
+// Success records a successful call to upstream.
+func (h *Health) Success(upstream string) {
+	h.record(upstream, outcome{at: time.Now(), ok: true})
+}
+
+// Failure records a call to upstream that failed, described by reason.
+func (h *Health) Failure(upstream, reason string) {
+	h.record(upstream, outcome{at: time.Now(), failure: reason})
+}
+
+func (h *Health) record(upstream string, o outcome) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	hist, ok := h.upstreams[upstream]
+	if !ok {
+		hist = &history{}
+		h.upstreams[upstream] = hist
+	}
+	hist.prune(o.at.Add(-h.window))
+	if len(hist.outcomes) >= maxOutcomes {
+		hist.outcomes = hist.outcomes[1:]
+	}
+	hist.outcomes = append(hist.outcomes, o)
+	hist.last = o
+	if !o.ok {
+		hist.lastFailure = o
+	}
+}
+
+// Status summarizes the calls to upstream within the window.
+func (h *Health) Status(upstream string) HealthStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	status := HealthStatus{SuccessRate: 1, LastOK: true}
+	hist, ok := h.upstreams[upstream]
+	if !ok {
+		return status
+	}
+	hist.prune(time.Now().Add(-h.window))
+
+	for _, o := range hist.outcomes {
+		status.Samples++
+		if o.ok {
+			status.Successes++
+		}
+	}
+	if status.Samples > 0 {
+		status.SuccessRate = float64(status.Successes) / float64(status.Samples)
+	}
+	status.LastOK = hist.last.ok
+	if !hist.lastFailure.at.IsZero() {
+		at := hist.lastFailure.at
+		status.LastFailure = hist.lastFailure.failure
+		status.LastFailureAt = &at
+	}
+	return status
+}
+
+// prune drops outcomes from before cutoff.
+func (hist *history) prune(cutoff time.Time) {
+	i := 0
+	for i < len(hist.outcomes) && hist.outcomes[i].at.Before(cutoff) {
+		i++
+	}
+	if i > 0 {
+		hist.outcomes = append(hist.outcomes[:0], hist.outcomes[i:]...)
+	}
+}
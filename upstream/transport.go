@@ -0,0 +1,212 @@
+// Package upstream makes outbound HTTP calls resilient: bounded retries with
+// jittered exponential backoff, and a circuit breaker per upstream host that
+// fails calls fast while the host is unhealthy.
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"weather-bff/logging"
+)
+
+// ErrCircuitOpen is returned, wrapped in a *url.Error by http.Client, for
+// calls rejected by an open breaker.
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// Policy configures a Transport.
+type Policy struct {
+	// MaxAttempts is the most times a request is tried, including the first.
+	MaxAttempts int
+	// BaseDelay is the backoff before the first retry; it doubles for each
+	// further retry up to MaxDelay. The actual wait is jittered below it.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// AttemptTimeout bounds each attempt. The request's context bounds the
+	// total.
+	AttemptTimeout time.Duration
+	// FailureThreshold consecutive failed calls, each counted once however
+	// many attempts it made, open a host's breaker, which then stays open for
+	// OpenTimeout before letting a probe through.
+	FailureThreshold int
+	OpenTimeout      time.Duration
+}
+
+// Transport is an http.RoundTripper adding retries and circuit breaking to
+// Next. Only GET and HEAD requests are retried. Transport errors, timeouts
+// and 5xx responses count as failures; anything else means the upstream is
+// healthy, even if it rejected the request.
+type Transport struct {
+	next   http.RoundTripper
+	policy Policy
+
+	mu       sync.Mutex
+	breakers map[string]*Breaker
+}
+
+// NewTransport wraps next, or http.DefaultTransport if nil.
+func NewTransport(next http.RoundTripper, policy Policy) *Transport {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &Transport{next: next, policy: policy, breakers: make(map[string]*Breaker)}
+}
+
+// Breakers returns the status of the breaker for every host seen so far.
+func (t *Transport) Breakers() map[string]BreakerStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	statuses := make(map[string]BreakerStatus, len(t.breakers))
+	for host, b := range t.breakers {
+		statuses[host] = b.Status()
+	}
+	return statuses
+}
+
+func (t *Transport) breaker(host string) *Breaker {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b, ok := t.breakers[host]
+	if !ok {
+		b = NewBreaker(t.policy.FailureThreshold, t.policy.OpenTimeout)
+		t.breakers[host] = b
+	}
+	return b
+}
+
+// RoundTrip implements http.RoundTripper. The breaker sees each call once,
+// however many attempts it took: retries of a call that fails anyway would
+// otherwise open it after a single bad call.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	b := t.breaker(req.URL.Host)
+	ctx := req.Context()
+
+	attempts := t.policy.MaxAttempts
+	if attempts < 1 || (req.Method != http.MethodGet && req.Method != http.MethodHead) {
+		attempts = 1
+	}
+
+	if !b.Allow() {
+		return nil, ErrCircuitOpen
+	}
+	for attempt := 1; ; attempt++ {
+		resp, err := t.attempt(req)
+		reason := failureReason(resp, err)
+		switch {
+		case reason == "":
+			b.Success()
+			return resp, nil
+		case unsent(err):
+			//Refused before it left, e.g. for lack of quota
+			b.Release()
+			return nil, err
+		case ctx.Err() != nil:
+			//The caller gave up; that says nothing about the upstream
+			b.Release()
+			return resp, err
+		}
+
+		if attempt >= attempts {
+			b.Failure(reason)
+			return resp, err
+		}
+		delay := t.backoff(attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			b.Failure(reason)
+			return resp, err
+		}
+		if resp != nil {
+			drain(resp.Body)
+		}
+
+		logging.FromContext(ctx).Warn("upstream retry", "url", logging.RedactURL(req.URL),
+			"reason", reason, "attempt", attempt, "delay_ms", delay)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			b.Release()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// attempt makes one try at req, bounded by the attempt timeout. The timeout
+// keeps applying while the caller reads the body.
+func (t *Transport) attempt(req *http.Request) (*http.Response, error) {
+	if t.policy.AttemptTimeout <= 0 {
+		return t.next.RoundTrip(req)
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), t.policy.AttemptTimeout)
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// backoff is the jittered delay before retry number n (1-based).
+func (t *Transport) backoff(n int) time.Duration {
+	delay := t.policy.BaseDelay << uint(n-1)
+	if delay <= 0 || delay > t.policy.MaxDelay {
+		delay = t.policy.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	//Equal jitter: at least half the delay, so retries still spread out
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// failureReason describes why resp/err counts against the upstream, or
+// returns "" if it doesn't.
+func failureReason(resp *http.Response, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	if resp.StatusCode >= 500 {
+		return fmt.Sprintf("status %d", resp.StatusCode)
+	}
+	return ""
+}
+
+// unsent reports whether err says the request was never sent, which the
+// RoundTripper under Transport signals with an error that has an Unsent
+// method returning true. Such failures say nothing about the upstream, and
+// are not retried.
+func unsent(err error) bool {
+	e, ok := err.(interface {
+		Unsent() bool
+	})
+	return ok && e.Unsent()
+}
+
+func drain(body io.ReadCloser) {
+	io.Copy(ioutil.Discard, io.LimitReader(body, 64<<10))
+	body.Close()
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
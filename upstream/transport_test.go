@@ -0,0 +1,189 @@
+package upstream
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// upstreamServer answers with the statuses in order, repeating the last.
+func upstreamServer(statuses ...int) (*httptest.Server, *int32) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(atomic.AddInt32(&calls, 1))
+		if n > len(statuses) {
+			n = len(statuses)
+		}
+		w.WriteHeader(statuses[n-1])
+	}))
+	return srv, &calls
+}
+
+var testPolicy = Policy{
+	MaxAttempts:      3,
+	BaseDelay:        time.Millisecond,
+	MaxDelay:         4 * time.Millisecond,
+	FailureThreshold: 2,
+	OpenTimeout:      time.Minute,
+}
+
+func get(t *testing.T, tr *Transport, url string) (*http.Response, error) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := tr.RoundTrip(req)
+	if err == nil {
+		resp.Body.Close()
+	}
+	return resp, err
+}
+
+func TestTransportRetries(t *testing.T) {
+	for name, tc := range map[string]struct {
+		statuses   []int
+		wantStatus int
+		wantCalls  int32
+	}{
+		"recovers":       {[]int{500, 502, 200}, 200, 3},
+		"gives up":       {[]int{503}, 503, 3},
+		"client error":   {[]int{404}, 404, 1},
+		"first try good": {[]int{200}, 200, 1},
+	} {
+		srv, calls := upstreamServer(tc.statuses...)
+		tr := NewTransport(nil, testPolicy)
+
+		resp, err := get(t, tr, srv.URL)
+		srv.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if resp.StatusCode != tc.wantStatus || *calls != tc.wantCalls {
+			t.Errorf("%s: status %d after %d calls, want %d after %d", name, resp.StatusCode, *calls, tc.wantStatus, tc.wantCalls)
+		}
+	}
+}
+
+func TestTransportDoesNotRetryPost(t *testing.T) {
+	srv, calls := upstreamServer(500, 200)
+	defer srv.Close()
+	tr := NewTransport(nil, testPolicy)
+
+	req, _ := http.NewRequest(http.MethodPost, srv.URL, nil)
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 500 || *calls != 1 {
+		t.Errorf("POST got %d after %d calls, want 500 after one", resp.StatusCode, *calls)
+	}
+}
+
+func TestTransportBreakerCountsCallsNotAttempts(t *testing.T) {
+	srv, calls := upstreamServer(500)
+	defer srv.Close()
+	tr := NewTransport(nil, testPolicy)
+	host := srv.Listener.Addr().String()
+
+	//One failed call, however many attempts, is one failure
+	get(t, tr, srv.URL)
+	status := tr.Breakers()[host]
+	if status.State != StateClosed || status.Failures != 1 || *calls != 3 {
+		t.Fatalf("after one failed call of 3 attempts: %+v, %d calls; want closed with 1 failure", status, *calls)
+	}
+
+	get(t, tr, srv.URL)
+	if state := tr.Breakers()[host].State; state != StateOpen {
+		t.Fatalf("after FailureThreshold failed calls the breaker is %s, want open", state)
+	}
+	if _, err := get(t, tr, srv.URL); err != ErrCircuitOpen {
+		t.Errorf("call with the breaker open: got %v, want ErrCircuitOpen", err)
+	}
+	if *calls != 6 {
+		t.Errorf("upstream saw %d attempts, want none while open", *calls)
+	}
+}
+
+func TestTransportCallerGivesUp(t *testing.T) {
+	srv, _ := upstreamServer(500)
+	defer srv.Close()
+	policy := testPolicy
+	policy.BaseDelay, policy.MaxDelay = time.Minute, time.Minute
+	tr := NewTransport(nil, policy)
+
+	//The first retry would wait past the deadline, so the call stops there
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	start := time.Now()
+	resp, err := tr.RoundTrip(req.WithContext(ctx))
+	if err != nil || resp.StatusCode != 500 {
+		t.Fatalf("got %v, %v; want the 500 without waiting", resp, err)
+	}
+	resp.Body.Close()
+	if elapsed := time.Since(start); elapsed > 40*time.Millisecond {
+		t.Errorf("call took %v, want no backoff past the deadline", elapsed)
+	}
+	if status := tr.Breakers()[srv.Listener.Addr().String()]; status.Failures != 1 {
+		t.Errorf("breaker = %+v, want the call counted once", status)
+	}
+}
+
+type unsentError struct{}
+
+func (unsentError) Error() string { return "not sent" }
+func (unsentError) Unsent() bool  { return true }
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func TestTransportUnsentIsNotAFailure(t *testing.T) {
+	var calls int32
+	tr := NewTransport(roundTripFunc(func(*http.Request) (*http.Response, error) {
+		atomic.AddInt32(&calls, 1)
+		return nil, unsentError{}
+	}), testPolicy)
+
+	for i := 0; i < 3; i++ {
+		if _, err := get(t, tr, "http://upstream.test/"); err != (unsentError{}) {
+			t.Fatalf("got %v, want the unsent error", err)
+		}
+	}
+	if status := tr.Breakers()["upstream.test"]; status.State != StateClosed || status.Failures != 0 {
+		t.Errorf("breaker = %+v, want unsent calls not counted", status)
+	}
+	if calls != 3 {
+		t.Errorf("%d attempts, want unsent calls not retried", calls)
+	}
+}
+
+func TestBackoffLimits(t *testing.T) {
+	tr := NewTransport(nil, Policy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second})
+	for _, tc := range []struct {
+		retry int
+		max   time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, time.Second},
+		//Large shifts overflow; they are capped all the same
+		{70, time.Second},
+	} {
+		for i := 0; i < 100; i++ {
+			if d := tr.backoff(tc.retry); d < tc.max/2 || d > tc.max {
+				t.Fatalf("backoff(%d) = %v, want between %v and %v", tc.retry, d, tc.max/2, tc.max)
+			}
+		}
+	}
+
+	if d := NewTransport(nil, Policy{}).backoff(1); d != 0 {
+		t.Errorf("backoff with no delays = %v, want 0", d)
+	}
+}